@@ -0,0 +1,170 @@
+package statsite
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// aggregator combines counters, gauges and sets with the same key between
+// flushes so that each key is sent as a single line. Keys are drained in the
+// order they were first seen.
+type aggregator struct {
+	lock    sync.Mutex
+	entries map[string]*aggregate
+	order   []*aggregate
+	// size is the number of messages the next drain returns
+	size int
+}
+
+type aggregate struct {
+	msg   message
+	count int64
+	// gauge is the last absolute value of a gauge, if absolute is set, and
+	// delta the sum of the deltas since
+	gauge    float64
+	absolute bool
+	delta    float64
+	// members are the unique members of a set in the order they were seen
+	members []string
+	seen    map[string]struct{}
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{entries: make(map[string]*aggregate)}
+}
+
+// identity returns the key under which messages are combined
+func identity(m message) string {
+	var b bytes.Buffer
+	b.WriteString(string(m.Type))
+	b.WriteByte('|')
+	b.WriteString(m.Prefix)
+	b.WriteByte('.')
+	b.WriteString(m.Key)
+	for _, tag := range m.Tags {
+		b.WriteByte('|')
+		b.WriteString(tag.Key)
+		b.WriteByte('=')
+		b.WriteString(tag.Value)
+	}
+	return b.String()
+}
+
+// add combines m with any earlier message with the same key, returning false
+// if m is not a kind of message that can be aggregated
+func (a *aggregator) add(m message) bool {
+	var count int64
+	var gauge float64
+	switch m.Type {
+	case TYPE_COUNTER:
+		if m.kind == valueInt {
+			count = m.intValue
+		} else {
+			value, err := strconv.ParseInt(m.Value, 10, 64)
+			if err != nil {
+				return false
+			}
+			count = value
+		}
+		if m.sampled() {
+			// Scale sampled counts up here since the sum is sent unsampled
+			count = int64(math.Floor(float64(count)/m.Rate + 0.5))
+		}
+	case TYPE_GAUGE:
+		value, err := m.number()
+		if err != nil {
+			return false
+		}
+		gauge = value
+	case TYPE_SET:
+	default:
+		return false
+	}
+
+	id := identity(m)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	e := a.entries[id]
+	if e == nil {
+		e = &aggregate{msg: m}
+		e.msg.Rate = 0
+		a.entries[id] = e
+		a.order = append(a.order, e)
+		if m.Type != TYPE_SET {
+			a.size++
+		}
+	}
+	switch m.Type {
+	case TYPE_COUNTER:
+		e.count += count
+	case TYPE_GAUGE:
+		if m.isDelta() {
+			e.delta += gauge
+		} else {
+			// An absolute value replaces everything before it
+			e.msg = m
+			e.gauge = gauge
+			e.absolute = true
+			e.delta = 0
+		}
+	case TYPE_SET:
+		if e.seen == nil {
+			e.seen = make(map[string]struct{})
+		}
+		member := string(m.appendValue(nil))
+		if _, ok := e.seen[member]; !ok {
+			e.seen[member] = struct{}{}
+			e.members = append(e.members, member)
+			a.size++
+		}
+	}
+	return true
+}
+
+// len returns the number of messages held until the next drain
+func (a *aggregator) len() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.size
+}
+
+// drain returns a message for every key seen since the last drain
+func (a *aggregator) drain() []message {
+	a.lock.Lock()
+	order := a.order
+	a.entries = make(map[string]*aggregate, len(order))
+	a.order = nil
+	a.size = 0
+	a.lock.Unlock()
+
+	var messages []message
+	for _, e := range order {
+		m := e.msg
+		switch m.Type {
+		case TYPE_COUNTER:
+			m.kind = valueInt
+			m.intValue = e.count
+			messages = append(messages, m)
+		case TYPE_GAUGE:
+			if !e.absolute {
+				m.kind = valueFloat
+				m.floatValue = e.delta
+				m.delta = true
+			} else if e.delta != 0 {
+				m.kind = valueFloat
+				m.floatValue = e.gauge + e.delta
+				m.delta = false
+			}
+			messages = append(messages, m)
+		case TYPE_SET:
+			m.kind = valueString
+			for _, member := range e.members {
+				m.Value = member
+				messages = append(messages, m)
+			}
+		}
+	}
+	return messages
+}
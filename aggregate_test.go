@@ -0,0 +1,129 @@
+package statsite
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AggregateSuite struct {
+	mockNetwork  Network
+	mockStatsite *mockStatsite
+}
+
+var _ = Suite(&AggregateSuite{})
+
+func (s *AggregateSuite) SetUpTest(c *C) {
+	s.mockStatsite = &mockStatsite{}
+	serverMap := make(map[string]mockServer)
+	serverMap["statsite"] = mockServer(s.mockStatsite)
+	s.mockNetwork = NewMockNetwork(serverMap)
+}
+
+// value returns the message behind a Message made by a constructor
+func value(m Message) message {
+	return *m.(*message)
+}
+
+func drained(a *aggregator) []string {
+	var lines []string
+	for _, m := range a.drain() {
+		lines = append(lines, m.String())
+	}
+	return lines
+}
+
+func (s *AggregateSuite) TestCounters(c *C) {
+	a := newAggregator()
+	c.Assert(a.add(value(NewCounter("hits", 1))), Equals, true)
+	c.Assert(a.add(value(NewCounter("hits", 2))), Equals, true)
+	c.Assert(a.add(value(Sampled(NewCounter("hits", 1), 0.5))), Equals, true)
+	c.Assert(a.add(value(Tagged(NewCounter("hits", 4), TagsInKey, Tag{"a", "b"}))), Equals, true)
+	c.Assert(drained(a), DeepEquals, []string{"hits:5|c\n", "hits.a.b:4|c\n"})
+	// Draining starts over
+	c.Assert(drained(a), IsNil)
+}
+
+func (s *AggregateSuite) TestGauges(c *C) {
+	a := newAggregator()
+	a.add(value(NewGauge("load", 1)))
+	a.add(value(NewGauge("load", 3)))
+	a.add(value(NewGauge("load", 2)))
+	c.Assert(drained(a), DeepEquals, []string{"load:2|g\n"})
+}
+
+func (s *AggregateSuite) TestSets(c *C) {
+	a := newAggregator()
+	a.add(value(NewSet("users", "x")))
+	a.add(value(NewSet("users", "y")))
+	a.add(value(NewSet("users", "x")))
+	c.Assert(drained(a), DeepEquals, []string{"users:x|s\n", "users:y|s\n"})
+}
+
+func (s *AggregateSuite) TestPassThrough(c *C) {
+	a := newAggregator()
+	c.Assert(a.add(value(NewKeyValue("key", "value"))), Equals, false)
+	c.Assert(a.add(value(NewTimerDuration("time", 0))), Equals, false)
+	c.Assert(drained(a), IsNil)
+}
+
+func (s *AggregateSuite) TestFlushAggregated(c *C) {
+	st := New("foo", NewNetworkClient("statsite", s.mockNetwork), WithAggregation(time.Hour))
+	for i := 0; i < 1000; i++ {
+		st.CounterAt("hits", 1).Emit()
+		st.GaugeAt("load", i).Emit()
+	}
+	st.KeyValue("key", "value").Emit()
+	st.Shutdown()
+	lines := s.mockStatsite.Read()
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{"foo.hits:1000|c\n", "foo.key:value|kv\n", "foo.load:999|g\n"})
+}
+
+func (s *AggregateSuite) TestShutdownUnreachable(c *C) {
+	st := New("foo", NewNetworkClient("badconnection", s.mockNetwork),
+		WithAggregation(time.Hour),
+		WithBackoff(ConstantBackoff(time.Millisecond)),
+	)
+	for _, key := range []string{"a", "b", "c", "a"} {
+		st.CounterAt(key, 1).Emit()
+	}
+	err := st.ShutdownContext(context.Background())
+	c.Assert(err, DeepEquals, &ShutdownError{Unflushed: 3})
+	c.Assert(st.Stats().DroppedDisconnected, Equals, uint64(3))
+}
+
+func (s *AggregateSuite) TestShutdownGivesUpAggregated(c *C) {
+	st := New("foo", NewNetworkClient("badconnection", s.mockNetwork),
+		WithAggregation(time.Hour),
+		WithBackoff(ConstantBackoff(time.Hour)),
+	)
+	for _, key := range []string{"a", "b", "c", "a"} {
+		st.CounterAt(key, 1).Emit()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := st.ShutdownContext(ctx)
+	c.Assert(err, DeepEquals, &ShutdownError{Unflushed: 3, Err: context.DeadlineExceeded})
+}
+
+func (s *AggregateSuite) TestGaugeDeltas(c *C) {
+	a := newAggregator()
+	a.add(value(NewGaugeDelta("load", 5)))
+	a.add(value(NewGaugeDelta("load", -7)))
+	c.Assert(drained(a), DeepEquals, []string{"load:-2|g\n"})
+	// Deltas before an absolute value are replaced by it and deltas after
+	// it are added to it
+	a.add(value(NewGaugeDelta("load", 5)))
+	a.add(value(NewGauge("load", 10)))
+	a.add(value(NewGaugeDelta("load", -3)))
+	a.add(value(NewCounter("hits", 1)))
+	a.add(value(NewGaugeDelta("queue", 2)))
+	c.Assert(drained(a), DeepEquals, []string{"load:7|g\n", "hits:1|c\n", "queue:+2|g\n"})
+	// A negative absolute value is not a delta
+	a.add(value(NewGaugeDelta("load", 5)))
+	a.add(value(NewGauge("load", -5)))
+	c.Assert(drained(a), DeepEquals, []string{"load:0|g\nload:-5|g\n"})
+}
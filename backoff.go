@@ -0,0 +1,90 @@
+package statsite
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long to wait before retrying after a failure
+type Backoff interface {
+	// Next returns the delay before the given retry, counting from 1
+	Next(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same duration before every retry
+type ConstantBackoff time.Duration
+
+// Next returns the constant delay
+func (b ConstantBackoff) Next(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff doubles the delay before each retry, starting at Base and
+// never exceeding Max. Jitter, between 0 and 1, is the fraction of each delay
+// that is randomized so that a fleet of clients don't all retry in step.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// Next returns the capped, jittered delay before the given retry
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	d := b.Base
+	for i := 1; i < attempt && d < math.MaxInt64/2; i++ {
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	jitter := math.Min(math.Max(b.Jitter, 0), 1)
+	if jitter > 0 {
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
+
+// defaultBackoff is used by the flusher when no Backoff is given. It starts
+// retrying quickly and backs off to at most ErrorWaitTime.
+func defaultBackoff() Backoff {
+	return ExponentialBackoff{
+		Base:   100 * time.Millisecond,
+		Max:    ErrorWaitTime,
+		Jitter: 0.5,
+	}
+}
+
+// redial paces connection attempts according to a Backoff
+type redial struct {
+	backoff  Backoff
+	failures int
+	retryAt  time.Time
+}
+
+// allow returns an error if the Backoff says it is too soon to dial again
+func (r *redial) allow() error {
+	if r.backoff == nil || r.failures == 0 {
+		return nil
+	}
+	if wait := r.retryAt.Sub(time.Now()); wait > 0 {
+		return fmt.Errorf("backing off for %v after %d failed attempts", wait, r.failures)
+	}
+	return nil
+}
+
+func (r *redial) failed() {
+	if r.backoff == nil {
+		return
+	}
+	r.failures++
+	r.retryAt = time.Now().Add(r.backoff.Next(r.failures))
+}
+
+func (r *redial) succeeded() {
+	r.failures = 0
+}
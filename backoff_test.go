@@ -0,0 +1,41 @@
+package statsite
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BackoffSuite struct{}
+
+var _ = Suite(&BackoffSuite{})
+
+func (s *BackoffSuite) TestConstant(c *C) {
+	b := ConstantBackoff(time.Second)
+	c.Assert(b.Next(1), Equals, time.Second)
+	c.Assert(b.Next(10), Equals, time.Second)
+}
+
+func (s *BackoffSuite) TestExponential(c *C) {
+	b := ExponentialBackoff{Base: time.Second, Max: 10 * time.Second}
+	c.Assert(b.Next(1), Equals, time.Second)
+	c.Assert(b.Next(2), Equals, 2*time.Second)
+	c.Assert(b.Next(3), Equals, 4*time.Second)
+	c.Assert(b.Next(4), Equals, 8*time.Second)
+	c.Assert(b.Next(5), Equals, 10*time.Second)
+	c.Assert(b.Next(1000), Equals, 10*time.Second)
+}
+
+func (s *BackoffSuite) TestExponentialUncapped(c *C) {
+	b := ExponentialBackoff{Base: time.Second}
+	c.Assert(b.Next(1000) > 0, Equals, true)
+}
+
+func (s *BackoffSuite) TestExponentialJitter(c *C) {
+	b := ExponentialBackoff{Base: time.Second, Max: 8 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := b.Next(4)
+		c.Assert(d >= 4*time.Second, Equals, true)
+		c.Assert(d <= 8*time.Second, Equals, true)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +16,19 @@ type Network interface {
 	DialTimeout(connType string, address string, timeout time.Duration) (net.Conn, error)
 }
 
+// UDPResolver is implemented by a Network that can resolve udp addresses.
+// UDP addresses are not resolved before dialing on a Network without it.
+type UDPResolver interface {
+	ResolveUDPAddr(connType string, address string) error
+}
+
+// UnixResolver is implemented by a Network that can resolve the paths of unix
+// domain sockets. They are not resolved before dialing on a Network without
+// it.
+type UnixResolver interface {
+	ResolveUnixAddr(connType string, address string) error
+}
+
 type realNetwork struct{}
 
 // NewRealNetwork returns a real network pointer
@@ -27,7 +42,19 @@ func (t realNetwork) ResolveTCPAddr(connType string, address string) error {
 	return err
 }
 
-// DialTimeout connects to the tcp address
+// ResolveUDPAddr resolves the udp address host:port in the address string
+func (t realNetwork) ResolveUDPAddr(connType string, address string) error {
+	_, err := net.ResolveUDPAddr(connType, address)
+	return err
+}
+
+// ResolveUnixAddr resolves the path of a unix domain socket
+func (t realNetwork) ResolveUnixAddr(connType string, address string) error {
+	_, err := net.ResolveUnixAddr(connType, address)
+	return err
+}
+
+// DialTimeout connects to the address
 func (t realNetwork) DialTimeout(connType string, address string, timeout time.Duration) (net.Conn, error) {
 	conn, err := net.DialTimeout(connType, address, timeout)
 	return conn, err
@@ -54,6 +81,18 @@ func (t mockNetwork) ResolveTCPAddr(connType string, address string) error {
 	return nil
 }
 
+// ResolveUDPAddr mocks the resolve call and returns an error if the address
+// is the string "invalid"
+func (t mockNetwork) ResolveUDPAddr(connType string, address string) error {
+	return t.ResolveTCPAddr(connType, address)
+}
+
+// ResolveUnixAddr mocks the resolve call and returns an error if the address
+// is the string "invalid"
+func (t mockNetwork) ResolveUnixAddr(connType string, address string) error {
+	return t.ResolveTCPAddr(connType, address)
+}
+
 // DialTimeout mocks the connect call and returns an error if the address does
 // not match a mockServer in the network map
 func (t mockNetwork) DialTimeout(connType string, address string, timeout time.Duration) (net.Conn, error) {
@@ -69,25 +108,182 @@ func (t mockNetwork) DialTimeout(connType string, address string, timeout time.D
 type Client interface {
 	Emit(msg Message) error
 	Connect() error
-	Close()
+	// Close closes the connection, returning any error from closing it
+	Close() error
+	// Connected reports whether the Client holds a connection. It is safe to
+	// call from any goroutine.
+	Connected() bool
+}
+
+// Flusher is implemented by Clients that buffer emitted Messages and need to
+// be told when to write them out
+type Flusher interface {
+	Flush() error
+}
+
+// ClientOptions configures the Clients created by NewClientWithOptions and
+// NewUDPClientWithOptions
+type ClientOptions struct {
+	// Network is the Network to connect over, a realNetwork when nil
+	Network Network
+	// Backoff paces Connect after a failed attempt. Until the Backoff's delay
+	// has passed, Connect returns an error without dialing. A nil Backoff
+	// dials on every call.
+	Backoff Backoff
+	// PacketSize is the largest datagram a UDP client sends. Zero uses
+	// DefaultPacketSize.
+	PacketSize int
+	// Encoder chooses the wire format of the messages sent, the
+	// StatsiteEncoder when nil
+	Encoder Encoder
+	// DialTimeout limits how long Connect waits for a connection. Zero uses
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+	// WriteTimeout limits how long each write may block, so that a statsite
+	// that stops reading cannot wedge the flusher. Zero uses
+	// DefaultWriteTimeout and a negative timeout never expires.
+	WriteTimeout time.Duration
+	// IdleTimeout reconnects before writing to a connection that has not
+	// been written to for longer than the timeout, since a firewall or load
+	// balancer may have dropped it. Zero never reconnects.
+	IdleTimeout time.Duration
+}
+
+var (
+	// DefaultDialTimeout is how long Connect waits for a connection unless
+	// ClientOptions say otherwise
+	DefaultDialTimeout = 1 * time.Second
+	// DefaultWriteTimeout is how long a write may block unless ClientOptions
+	// say otherwise
+	DefaultWriteTimeout = 1 * time.Second
+)
+
+func (o ClientOptions) network() Network {
+	if o.Network == nil {
+		return &realNetwork{}
+	}
+	return o.Network
+}
+
+func (o ClientOptions) dialTimeout() time.Duration {
+	if o.DialTimeout <= 0 {
+		return DefaultDialTimeout
+	}
+	return o.DialTimeout
+}
+
+func (o ClientOptions) deadlines() deadlines {
+	d := deadlines{write: o.WriteTimeout, idle: o.IdleTimeout}
+	if d.write == 0 {
+		d.write = DefaultWriteTimeout
+	}
+	return d
+}
+
+// deadlines applies the write and idle timeouts of ClientOptions to a
+// connection
+type deadlines struct {
+	write time.Duration
+	idle  time.Duration
+	// lastUsed is when the connection was made or last written to
+	lastUsed time.Time
+}
+
+// connected starts the idle timeout of a new connection
+func (d *deadlines) connected() {
+	d.lastUsed = time.Now()
+}
+
+// expired reports whether the connection has been idle for longer than the
+// idle timeout
+func (d *deadlines) expired() bool {
+	return d.idle > 0 && time.Now().Sub(d.lastUsed) > d.idle
+}
+
+// writeTo writes b to conn, giving up once the write timeout has passed
+func (d *deadlines) writeTo(conn net.Conn, b []byte) error {
+	now := time.Now()
+	if d.write > 0 {
+		if err := conn.SetWriteDeadline(now.Add(d.write)); err != nil {
+			return err
+		}
+	}
+	d.lastUsed = now
+	_, err := conn.Write(b)
+	return err
+}
+
+func (o ClientOptions) encoder() Encoder {
+	if o.Encoder == nil {
+		return StatsiteEncoder{}
+	}
+	return o.Encoder
+}
+
+// connState tracks whether a Client holds a connection so that Connected can
+// be called while another goroutine is emitting
+type connState struct {
+	connected int32
+}
+
+func (c *connState) set(connected bool) {
+	var v int32
+	if connected {
+		v = 1
+	}
+	atomic.StoreInt32(&c.connected, v)
+}
+
+// Connected reports whether the Client holds a connection
+func (c *connState) Connected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
 }
 
 // client is an implementation of the Client interface for connecting and
 // Emitting metrics
 type client struct {
-	Conn    net.Conn
-	addr    string
-	network Network
+	Conn net.Conn
+	addr string
+	// transport is "tcp", or "unix" for a unix:// address
+	transport string
+	network   Network
+	redial    redial
+	encoder   Encoder
+	timeout   time.Duration
+	deadlines deadlines
+	connState
+	// buf is reused to encode each message
+	buf []byte
+}
+
+// NewClientWithOptions takes an address string in the form "host:port" and
+// ClientOptions and returns a Client. An address of the form unix:///path
+// connects to a unix domain stream socket instead, and one of the form
+// unixgram:///path returns the datagram Client of NewUDPClientWithOptions.
+func NewClientWithOptions(addr string, opts ClientOptions) Client {
+	transport := "tcp"
+	if network, path, ok := splitUnixAddr(addr); ok {
+		if network == "unixgram" {
+			return NewUDPClientWithOptions(addr, opts)
+		}
+		transport, addr = network, path
+	}
+	return &client{
+		Conn:      nil,
+		addr:      addr,
+		transport: transport,
+		network:   opts.network(),
+		redial:    redial{backoff: opts.Backoff},
+		encoder:   opts.encoder(),
+		timeout:   opts.dialTimeout(),
+		deadlines: opts.deadlines(),
+	}
 }
 
 // NewNetworkClient takes an address string in the form "host:port" and
 // a Network and returns a Client
 func NewNetworkClient(addr string, network Network) Client {
-	return &client{
-		Conn:    nil,
-		addr:    addr,
-		network: network,
-	}
+	return NewClientWithOptions(addr, ClientOptions{Network: network})
 }
 
 // NewClient takes an address string in the form "host:port" and returns a
@@ -100,38 +296,63 @@ func NewClient(addr string) Client {
 // Connect instructs a Client to make a connection to the server at the address
 // specified in the client
 func (t *client) Connect() error {
-	err := t.network.ResolveTCPAddr("tcp", t.addr)
+	// Reconnecting replaces any connection already held
+	t.Close()
+
+	err := t.redial.allow()
 	if err != nil {
+		return fmt.Errorf("Error connecting to statsite: %v", err)
+	}
+
+	err = resolve(t.network, t.transport, t.addr)
+	if err != nil {
+		t.redial.failed()
 		return fmt.Errorf("Error resolving statsite: %v", err)
 	}
 
-	conn, err := t.network.DialTimeout("tcp", t.addr, 1*time.Second)
+	conn, err := t.network.DialTimeout(t.transport, t.addr, t.timeout)
 	if err != nil {
+		t.redial.failed()
 		return fmt.Errorf("Error connecting to statsite: %v", err)
 	}
+	t.redial.succeeded()
+	t.deadlines.connected()
 	t.Conn = conn
+	t.set(true)
 	return nil
 
 }
 
-// Close cleans up any connections
-func (t *client) Close() {
+// Close closes the connection, if there is one
+func (t *client) Close() error {
+	if t.Conn == nil {
+		return nil
+	}
+	err := t.Conn.Close()
 	t.Conn = nil
+	t.set(false)
+	return err
 }
 
 // Emit sends a message to the address defined in the client
 func (t *client) Emit(msg Message) error {
-	if t.Conn == nil {
+	if t.Conn == nil || t.deadlines.expired() {
 		err := t.Connect()
 		if err != nil {
 			return err
 		}
 	}
-	return t.emitter(msg.String())
+	t.buf = t.encoder.Encode(t.buf[:0], msg)
+	return t.emitter(t.buf)
+}
+
+// Encoder returns the Encoder the client sends messages with
+func (t *client) Encoder() Encoder {
+	return t.encoder
 }
 
-func (t *client) emitter(msg string) error {
-	_, err := t.Conn.Write([]byte(msg))
+func (t *client) emitter(msg []byte) error {
+	err := t.deadlines.writeTo(t.Conn, msg)
 	if err != nil {
 		return err
 	}
@@ -139,7 +360,9 @@ func (t *client) emitter(msg string) error {
 }
 
 type mockConnection struct {
-	server mockServer
+	server        mockServer
+	writeDeadline time.Time
+	closed        bool
 }
 
 // Read returns the number of messages sent to the mockConnection
@@ -157,8 +380,9 @@ func (t *mockConnection) Write(b []byte) (n int, err error) {
 	return 1, nil
 }
 
-// Close is a no-op for mockConnection
+// Close marks the mockConnection closed for tests to check
 func (t *mockConnection) Close() error {
+	t.closed = true
 	return nil
 }
 
@@ -188,8 +412,9 @@ func (t *mockConnection) SetReadDeadline(time time.Time) error {
 	return nil
 }
 
-// SetWriteDeadline is a no-op for mockConnection
+// SetWriteDeadline records the deadline for tests to check
 func (t *mockConnection) SetWriteDeadline(time time.Time) error {
+	t.writeDeadline = time
 	return nil
 }
 
@@ -213,21 +438,32 @@ type mockServer interface {
 	Read() []string
 	Last() string
 	Count() int
+	Writes() int
 }
 
 type mockStatsite struct {
 	receivedMessages []string
+	writes           int
 	lock             sync.Mutex
 }
 
-// Write takes a string and writes to the local cache for the mockStatsite
+// Write takes a string, which may hold several newline terminated messages,
+// and writes each message to the local cache for the mockStatsite
 func (t *mockStatsite) Write(s string) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	if s == "bad:key|kv\n" {
-		return errors.New("Error writing to statstie")
+	lines := strings.SplitAfter(s, "\n")
+	for _, line := range lines {
+		if line == "bad:key|kv\n" {
+			return errors.New("Error writing to statstie")
+		}
 	}
-	t.receivedMessages = append(t.receivedMessages, s)
+	for _, line := range lines {
+		if line != "" {
+			t.receivedMessages = append(t.receivedMessages, line)
+		}
+	}
+	t.writes++
 	return nil
 }
 
@@ -253,3 +489,11 @@ func (t *mockStatsite) Count() int {
 
 	return len(t.receivedMessages)
 }
+
+// Writes returns the number of writes, or packets, the mockStatsite received
+func (t *mockStatsite) Writes() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.writes
+}
@@ -1,7 +1,13 @@
 package statsite
 
 import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"runtime/debug"
+	"strings"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -120,3 +126,160 @@ func (s *ClientSuite) TestEmitFailure(c *C) {
 	// Expect no stats added to statsite
 	c.Assert(s.mockStatsite.Count(), Equals, 0)
 }
+
+func (s *ClientSuite) TestConnectBackoff(c *C) {
+	m := NewClientWithOptions("badconnection", ClientOptions{
+		Network: s.mockNetwork,
+		Backoff: ConstantBackoff(time.Hour),
+	})
+	err := m.Connect()
+	c.Assert(err, ErrorMatches, "Error connecting to statsite: Server not found.*")
+	// The next attempt is refused without dialing until the backoff passes
+	err = m.Connect()
+	c.Assert(err, ErrorMatches, "Error connecting to statsite: backing off .* after 1 failed attempts")
+}
+
+func (s *ClientSuite) TestConnectBackoffExpires(c *C) {
+	m := NewClientWithOptions("statsite", ClientOptions{
+		Network: s.mockNetwork,
+		Backoff: ConstantBackoff(0),
+	})
+	m.(*client).redial.failed()
+	c.Assert(m.Connect(), IsNil)
+	c.Assert(m.(*client).redial.failures, Equals, 0)
+}
+
+func (s *ClientSuite) TestWriteDeadline(c *C) {
+	m := NewClientWithOptions("statsite", ClientOptions{
+		Network:      s.mockNetwork,
+		WriteTimeout: time.Hour,
+	})
+	c.Assert(m.Emit(NewCounter("foo", 1)), IsNil)
+	deadline := m.(*client).Conn.(*mockConnection).writeDeadline
+	c.Assert(deadline.After(time.Now().Add(59*time.Minute)), Equals, true)
+
+	// A negative timeout sets no deadline
+	m = NewClientWithOptions("statsite", ClientOptions{
+		Network:      s.mockNetwork,
+		WriteTimeout: -1,
+	})
+	c.Assert(m.Emit(NewCounter("foo", 1)), IsNil)
+	c.Assert(m.(*client).Conn.(*mockConnection).writeDeadline.IsZero(), Equals, true)
+}
+
+func (s *ClientSuite) TestWriteTimeout(c *C) {
+	// A statsite that accepts connections but never reads from them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			<-done
+			conn.Close()
+		}
+	}()
+
+	m := NewClientWithOptions(l.Addr().String(), ClientOptions{WriteTimeout: 50 * time.Millisecond})
+	msg := NewKeyValue("key", strings.Repeat("x", 64*1024))
+	start := time.Now()
+	for err == nil && time.Since(start) < 5*time.Second {
+		err = m.Emit(msg)
+	}
+	c.Assert(err, NotNil)
+	netErr, ok := err.(net.Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(netErr.Timeout(), Equals, true)
+}
+
+func (s *ClientSuite) TestIdleTimeout(c *C) {
+	m := NewClientWithOptions("statsite", ClientOptions{
+		Network:     s.mockNetwork,
+		IdleTimeout: time.Millisecond,
+	})
+	c.Assert(m.Connect(), IsNil)
+	conn := m.(*client).Conn
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(m.Emit(NewCounter("foo", 1)), IsNil)
+	c.Assert(m.(*client).Conn == conn, Equals, false)
+	c.Assert(s.mockStatsite.Read(), DeepEquals, []string{"foo:1|c\n"})
+}
+
+func (s *ClientSuite) TestClose(c *C) {
+	m := NewNetworkClient("statsite", s.mockNetwork)
+	c.Assert(m.Connected(), Equals, false)
+	c.Assert(m.Connect(), IsNil)
+	c.Assert(m.Connected(), Equals, true)
+	conn := m.(*client).Conn.(*mockConnection)
+	c.Assert(m.Close(), IsNil)
+	c.Assert(conn.closed, Equals, true)
+	c.Assert(m.Connected(), Equals, false)
+	// Closing again does nothing
+	c.Assert(m.Close(), IsNil)
+}
+
+func (s *ClientSuite) TestConnectClosesPrevious(c *C) {
+	m := NewNetworkClient("statsite", s.mockNetwork)
+	c.Assert(m.Connect(), IsNil)
+	conn := m.(*client).Conn.(*mockConnection)
+	c.Assert(m.Connect(), IsNil)
+	c.Assert(conn.closed, Equals, true)
+	c.Assert(m.Connected(), Equals, true)
+}
+
+// openFiles counts the descriptors open in this process
+func openFiles(c *C) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		c.Skip("Descriptors cannot be counted on this system")
+	}
+	return len(fds)
+}
+
+func (s *ClientSuite) TestNoDescriptorLeak(c *C) {
+	// A statsite that drops every connection after the first line, so that
+	// the flusher has to reconnect
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				bufio.NewReader(conn).ReadString('\n')
+				conn.Close()
+			}()
+		}
+	}()
+
+	// Finalizers would close leaked connections if the garbage collector ran
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	before := openFiles(c)
+	m := NewClient(l.Addr().String())
+	for i := 0; i < 100; i++ {
+		c.Assert(m.Connect(), IsNil)
+	}
+	c.Assert(m.Close(), IsNil)
+
+	st := New("foo", NewClient(l.Addr().String()),
+		WithBatchSize(0),
+		WithBackoff(ConstantBackoff(0)),
+	)
+	for st.Stats().Reconnects < 50 {
+		st.CounterAt("hits", 1).Emit()
+		time.Sleep(time.Millisecond)
+	}
+	st.Shutdown()
+
+	// The listener closes its side of each connection as it sees the close
+	deadline := time.Now().Add(5 * time.Second)
+	for openFiles(c) > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(openFiles(c) <= before, Equals, true, Commentf("%d descriptors open, %d before", openFiles(c), before))
+}
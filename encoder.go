@@ -0,0 +1,202 @@
+package statsite
+
+import (
+	"strconv"
+	"time"
+)
+
+// Encoder writes messages in the wire format of a metrics backend. Only
+// messages created by this package can be re-encoded; the built in Encoders
+// write any other Message, such as a batch of lines that are already
+// encoded, using its own AppendTo.
+type Encoder interface {
+	// Encode appends msg, ending in a newline, to buf and returns the
+	// extended buffer
+	Encode(buf []byte, msg Message) []byte
+}
+
+// EncodingClient is a Client that sends messages using an Encoder. The
+// flusher encodes batches with the client's Encoder, so that the same
+// metrics can be sent to a backend that does not speak the statsite line
+// protocol.
+type EncodingClient interface {
+	Client
+	Encoder() Encoder
+}
+
+// messageEncoder is implemented by the built in Encoders so that the flusher
+// can encode queued messages without converting them to a Message, which
+// would allocate
+type messageEncoder interface {
+	encode(buf []byte, m message) []byte
+}
+
+// encoderOf returns the Encoder used by client, the StatsiteEncoder unless
+// client is an EncodingClient
+func encoderOf(client Client) Encoder {
+	if c, ok := client.(EncodingClient); ok && c.Encoder() != nil {
+		return c.Encoder()
+	}
+	return StatsiteEncoder{}
+}
+
+// appendMessage encodes m with enc, avoiding the conversion to a Message
+// when enc is one of the built in Encoders
+func appendMessage(enc Encoder, buf []byte, m message) []byte {
+	if e, ok := enc.(messageEncoder); ok {
+		return e.encode(buf, m)
+	}
+	return enc.Encode(buf, &m)
+}
+
+// encodeMessage calls encode for messages created by this package and
+// AppendTo for any other Message
+func encodeMessage(buf []byte, msg Message, encode func([]byte, message) []byte) []byte {
+	switch m := msg.(type) {
+	case *message:
+		return encode(buf, *m)
+	case message:
+		return encode(buf, m)
+	}
+	return msg.AppendTo(buf)
+}
+
+// StatsiteEncoder writes the statsite line protocol, key:value|type, which
+// statsd and DogStatsD also accept
+type StatsiteEncoder struct{}
+
+func (e StatsiteEncoder) Encode(buf []byte, msg Message) []byte {
+	return msg.AppendTo(buf)
+}
+
+func (e StatsiteEncoder) encode(buf []byte, m message) []byte {
+	return m.AppendTo(buf)
+}
+
+// GraphiteEncoder writes the Graphite plaintext protocol, key value
+// timestamp. Tags are written in the Graphite 1.1 form key;tag=value.
+// Graphite stores values as they are sent: sampled counters are scaled back
+// up, but counters are not summed, gauge deltas are written as the delta and
+// every member of a set is written as its own value.
+type GraphiteEncoder struct {
+	// Now returns the timestamp written with each message, time.Now when nil
+	Now func() time.Time
+}
+
+func (e GraphiteEncoder) Encode(buf []byte, msg Message) []byte {
+	return encodeMessage(buf, msg, e.encode)
+}
+
+func (e GraphiteEncoder) encode(buf []byte, m message) []byte {
+	if m.err != nil {
+		return buf
+	}
+	buf = appendPath(buf, m)
+	for _, tag := range m.Tags {
+		if tag.Value == "" {
+			// Graphite has no tags without values
+			continue
+		}
+		buf = append(buf, ';')
+		buf = append(buf, tag.Key...)
+		buf = append(buf, '=')
+		buf = append(buf, tag.Value...)
+	}
+	buf = append(buf, ' ')
+	buf = appendScaled(buf, m)
+	buf = append(buf, ' ')
+	now := time.Now
+	if e.Now != nil {
+		now = e.Now
+	}
+	buf = strconv.AppendInt(buf, now().Unix(), 10)
+	return append(buf, '\n')
+}
+
+// InfluxEncoder writes the InfluxDB line protocol with the value in a field
+// named value, key,tag=value value=1i. The timestamp is left to the server.
+// Like the GraphiteEncoder, sampled counters are scaled back up but values
+// are otherwise written as they are sent.
+type InfluxEncoder struct{}
+
+func (e InfluxEncoder) Encode(buf []byte, msg Message) []byte {
+	return encodeMessage(buf, msg, e.encode)
+}
+
+func (e InfluxEncoder) encode(buf []byte, m message) []byte {
+	if m.err != nil {
+		return buf
+	}
+	if m.Prefix != "" {
+		buf = appendInfluxEscaped(buf, m.Prefix)
+		buf = append(buf, '.')
+	}
+	buf = appendInfluxEscaped(buf, m.Key)
+	for _, tag := range m.Tags {
+		if tag.Value == "" {
+			// Influx has no tags without values
+			continue
+		}
+		buf = append(buf, ',')
+		buf = appendInfluxEscaped(buf, tag.Key)
+		buf = append(buf, '=')
+		buf = appendInfluxEscaped(buf, tag.Value)
+	}
+	buf = append(buf, " value="...)
+	if n, ok := m.integer(); ok && m.Type == TYPE_COUNTER && !m.sampled() {
+		// Counters are integer fields, everything else is a float field so
+		// that a measurement never changes field type
+		buf = strconv.AppendInt(buf, n, 10)
+		buf = append(buf, 'i')
+	} else if value, err := scaled(m); err == nil {
+		buf = strconv.AppendFloat(buf, value, 'f', FloatPrecision, 64)
+	} else {
+		buf = strconv.AppendQuote(buf, m.Value)
+	}
+	return append(buf, '\n')
+}
+
+// appendPath appends the prefix and key of m separated by a '.'
+func appendPath(buf []byte, m message) []byte {
+	if m.Prefix != "" {
+		buf = append(buf, m.Prefix...)
+		buf = append(buf, '.')
+	}
+	return append(buf, m.Key...)
+}
+
+// appendScaled appends the value of m as a plain number, without the sign
+// that marks a gauge delta, or as it is if it is not a number
+func appendScaled(buf []byte, m message) []byte {
+	if n, ok := m.integer(); ok && !m.sampled() {
+		return strconv.AppendInt(buf, n, 10)
+	}
+	value, err := scaled(m)
+	if err != nil {
+		return append(buf, m.Value...)
+	}
+	return strconv.AppendFloat(buf, value, 'f', FloatPrecision, 64)
+}
+
+// scaled returns the value of m, scaling sampled counters back up since
+// backends other than statsite do not understand sample rates
+func scaled(m message) (float64, error) {
+	value, err := m.number()
+	if err == nil && m.Type == TYPE_COUNTER && m.sampled() {
+		value /= m.Rate
+	}
+	return value, err
+}
+
+// appendInfluxEscaped appends s with the commas, equals signs and spaces that
+// separate parts of an Influx line escaped
+func appendInfluxEscaped(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ',', '=', ' ':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return buf
+}
@@ -0,0 +1,70 @@
+package statsite
+
+import (
+	"testing"
+	"time"
+)
+
+func encoded(e Encoder, msg Message) string {
+	return string(e.Encode(nil, msg))
+}
+
+func graphiteAt(sec int64) GraphiteEncoder {
+	return GraphiteEncoder{Now: func() time.Time { return time.Unix(sec, 0) }}
+}
+
+func TestStatsiteEncoder(t *testing.T) {
+	e := StatsiteEncoder{}
+	Assert(t, "foo:1|c\n", encoded(e, NewCounter("foo", 1)))
+	Assert(t, "foo:+2|g\n", encoded(e, NewGaugeDelta("foo", 2)))
+}
+
+func TestGraphiteEncoder(t *testing.T) {
+	e := graphiteAt(1500000000)
+	Assert(t, "foo 1 1500000000\n", encoded(e, NewCounter("foo", 1)))
+	Assert(t, "foo 2.5 1500000000\n", encoded(e, NewGaugeFloat("foo", 2.5)))
+	Assert(t, "foo 2 1500000000\n", encoded(e, NewGaugeDelta("foo", 2)))
+	Assert(t, "foo -2 1500000000\n", encoded(e, NewGaugeDelta("foo", -2)))
+	Assert(t, "foo 4 1500000000\n", encoded(e, Sampled(NewCounter("foo", 1), 0.25)))
+	Assert(t, "foo;a=b 1 1500000000\n", encoded(e, Tagged(NewCounter("foo", 1), TagsDogStatsD, Tag{"a", "b"}, Tag{"c", ""})))
+	// Rejected messages are never written
+	Assert(t, "", encoded(e, message{Key: "foo", Type: TYPE_COUNTER, err: &InvalidError{}}))
+}
+
+func TestInfluxEncoder(t *testing.T) {
+	e := InfluxEncoder{}
+	Assert(t, "foo value=1i\n", encoded(e, NewCounter("foo", 1)))
+	Assert(t, "foo value=4\n", encoded(e, Sampled(NewCounter("foo", 1), 0.25)))
+	Assert(t, "foo value=2.5\n", encoded(e, NewGaugeFloat("foo", 2.5)))
+	Assert(t, "foo value=3\n", encoded(e, NewGauge("foo", 3)))
+	Assert(t, "foo value=\"bar\"\n", encoded(e, NewKeyValue("foo", "bar")))
+	Assert(t, "foo,a=b\\,c value=1i\n", encoded(e, Tagged(NewCounter("foo", 1), TagsInKey, Tag{"a", "b,c"})))
+}
+
+func TestEncoderPassesThroughOtherMessages(t *testing.T) {
+	b := &batch{buf: []byte("foo:1|c\n")}
+	Assert(t, "foo:1|c\n", encoded(graphiteAt(0), b))
+	Assert(t, "foo:1|c\n", encoded(InfluxEncoder{}, b))
+}
+
+func TestEncoderPrefix(t *testing.T) {
+	m := *NewCounter("bar", 1).(*message)
+	m.Prefix = "foo"
+	Assert(t, "foo.bar 1 0\n", encoded(graphiteAt(0), m))
+	Assert(t, "foo.bar value=1i\n", encoded(InfluxEncoder{}, m))
+}
+
+func TestClientEncoder(t *testing.T) {
+	server := &mockStatsite{}
+	network := NewMockNetwork(map[string]mockServer{"statsite": server})
+	client := NewClientWithOptions("statsite", ClientOptions{
+		Network: network,
+		Encoder: graphiteAt(1500000000),
+	})
+	s := New("prefix", client, WithStatsInterval(time.Hour))
+	s.CounterAt("foo", 2).Emit()
+	s.Shutdown()
+	lines := server.Read()
+	Assert(t, 1, len(lines))
+	Assert(t, "prefix.foo 2 1500000000\n", lines[0])
+}
@@ -1,140 +1,697 @@
 package statsite
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const ChannelSize = 8096
 
-// enabled controls whether to enable StatsiteMetrics
-var enabled = false
-var l sync.Mutex
-
-// ErrorWaitTime represents the Time to wait on error
+// ErrorWaitTime represents the longest Time the default Backoff waits on error
 var ErrorWaitTime = time.Duration(10 * time.Second)
 
 // ShutdownTimeout represents how long each waitgroup is given to shutdown
 // cleanly
 var ShutdownTimeout = time.Duration(10 * time.Second)
 
-// Metric Prefix
-var metricPrefix string
+// DefaultBatchSize is the number of bytes of messages the flusher collects
+// before writing them to statsite in a single call
+const DefaultBatchSize = DefaultPacketSize
+
+// DefaultFlushInterval is the longest a message waits in a partially filled
+// batch before the batch is written
+var DefaultFlushInterval = time.Duration(100 * time.Millisecond)
+
+// Option configures the flusher started by Initialize and InitializeWithClient
+type Option func(*options)
+
+type options struct {
+	batchSize     int
+	flushInterval time.Duration
+	backoff       Backoff
+	retryMessages int
+	retryBytes    int
+	retryPolicy   DropPolicy
+	statsInterval time.Duration
+	tagFormat     TagFormat
+	randSource    rand.Source
+	aggregate     time.Duration
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		batchSize:     DefaultBatchSize,
+		flushInterval: DefaultFlushInterval,
+		backoff:       defaultBackoff(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.flushInterval <= 0 {
+		o.flushInterval = DefaultFlushInterval
+	}
+	if o.randSource == nil {
+		o.randSource = rand.NewSource(time.Now().UnixNano())
+	}
+	return o
+}
+
+// WithBatchSize sets the number of bytes of messages collected before they
+// are written in one call. A size of zero or less writes every message as
+// soon as it is received.
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		o.batchSize = size
+	}
+}
+
+// WithFlushInterval sets the longest a message waits in a partially filled
+// batch before the batch is written. An interval of zero or less uses
+// DefaultFlushInterval.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.flushInterval = interval
+	}
+}
+
+// State is a stage in the lifecycle of a Statsite
+type State int32
+
+const (
+	// StateUninitialized is a Statsite that has never been started
+	StateUninitialized State = iota
+	// StateRunning is a Statsite that is accepting and flushing metrics
+	StateRunning
+	// StateDraining is a Statsite that is flushing its last metrics
+	StateDraining
+	// StateStopped is a Statsite that has been shut down. It can be started
+	// again.
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateUninitialized:
+		return "uninitialized"
+	case StateRunning:
+		return "running"
+	case StateDraining:
+		return "draining"
+	case StateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("State(%d)", int32(s))
+}
+
+// Statsite owns a statsite client along with the metric prefix, queue and
+// flusher used to deliver metrics to it. Each Statsite is independent, so a
+// process can send metrics to several servers or under several prefixes.
+type Statsite struct {
+	// stats is first to keep its 64-bit counters aligned for atomic access
+	stats statsCounters
+
+	// Metric Prefix
+	prefix string
+	// prefixErr is why the DefaultSanitizer rejected the prefix, in which
+	// case no metrics are sent
+	prefixErr error
+	tagFormat TagFormat
+
+	// run is the queue and flusher of the current Initialize to Shutdown
+	// cycle
+	run *run
+
+	// rand decides which sampled metrics are emitted
+	rand     *rand.Rand
+	randLock sync.Mutex
+
+	// state is the State of the Statsite and only changes while holding l.
+	// Emitting holds a read lock on l so that draining waits for any metrics
+	// being added to the queue.
+	state int32
+	l     sync.RWMutex
+
+	// lifecycle serializes starting and shutting down
+	lifecycle sync.Mutex
+}
+
+// run holds what belongs to a single Initialize to Shutdown cycle, so that a
+// flusher that outlives its Shutdown never touches the next cycle's queue
+type run struct {
+	// pending is the number of messages the flusher has taken from the
+	// queue but not yet written. It is first to stay aligned for atomic
+	// access.
+	pending int64
+	queue   chan message
+	// aggregator combines metrics between flushes when aggregation is on
+	aggregator *aggregator
+	// stop is closed when a shutdown runs out of time, telling the flusher
+	// to give up on what it holds and exit
+	stop chan struct{}
+	// done is closed when the flusher exits
+	done chan struct{}
+}
+
+// std is the Statsite used by the package level functions
+var std = &Statsite{}
+
+// New takes a statsite client, starts the flusher and returns a Statsite
+// that prefixes all of its metrics with prefix
+func New(prefix string, client Client, opts ...Option) *Statsite {
+	s := &Statsite{}
+	s.start(prefix, client, opts)
+	return s
+}
+
+// WithBackoff sets the Backoff the flusher follows between attempts to
+// reconnect to statsite. The default backs off exponentially with jitter from
+// 100ms up to ErrorWaitTime.
+func WithBackoff(backoff Backoff) Option {
+	return func(o *options) {
+		o.backoff = backoff
+	}
+}
+
+// WithRetryBuffer holds up to maxMessages messages, totalling no more than
+// maxBytes, that are received while statsite is unreachable and replays them
+// once the flusher reconnects. A limit of zero or less is not enforced, but at
+// least one must be set. When the buffer is full, policy decides whether the
+// oldest or newest message is dropped. Without a retry buffer those messages
+// are discarded.
+func WithRetryBuffer(maxMessages, maxBytes int, policy DropPolicy) Option {
+	return func(o *options) {
+		o.retryMessages = maxMessages
+		o.retryBytes = maxBytes
+		o.retryPolicy = policy
+	}
+}
+
+// WithStatsInterval emits the Statsite's own Stats as counters named
+// <prefix>.statsite_client.* every interval. Stats are not emitted by default.
+func WithStatsInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.statsInterval = interval
+	}
+}
+
+// WithTagFormat sets how the tags added to metrics are encoded. The default,
+// TagsInKey, folds them into the key for plain statsite.
+func WithTagFormat(format TagFormat) Option {
+	return func(o *options) {
+		o.tagFormat = format
+	}
+}
+
+// WithRandSource sets the source of randomness that decides which sampled
+// metrics are emitted. Tests can use a fixed seed for repeatable sampling.
+func WithRandSource(src rand.Source) Option {
+	return func(o *options) {
+		o.randSource = src
+	}
+}
 
-var statQueue chan Message
-var flushWG sync.WaitGroup
+// WithAggregation combines metrics in memory and sends them every interval:
+// counters with the same key and tags are summed, gauges keep their last
+// value and set members are de-duplicated. Other metrics are sent as usual.
+func WithAggregation(interval time.Duration) Option {
+	return func(o *options) {
+		o.aggregate = interval
+	}
+}
 
 // Initialize creates a new statsite client and starts the flusher
-func Initialize(hostname string, prefix string) {
+func Initialize(hostname string, prefix string, opts ...Option) {
 	client := NewClient(hostname)
 	log.Printf("Starting stats collector [%s] on [%s]\n", prefix, hostname)
-	InitializeWithClient(prefix, client)
+	InitializeWithClient(prefix, client, opts...)
 }
 
 // InitializeWithClient creates takes a statsite client and starts the flusher
-func InitializeWithClient(prefix string, client Client) {
-	enable()
-	metricPrefix = prefix
-	statQueue = make(chan Message, ChannelSize)
-	flushWG.Add(1)
-	go flush(client)
+func InitializeWithClient(prefix string, client Client, opts ...Option) {
+	std.start(prefix, client, opts)
+}
+
+// State returns the current State of the Statsite
+func (s *Statsite) State() State {
+	return State(atomic.LoadInt32(&s.state))
 }
 
-func flush(client Client) {
-	defer flushWG.Done()
-	if !enabled {
-		return
+// running reports whether the Statsite is accepting metrics
+func (s *Statsite) running() bool {
+	return s.State() == StateRunning
+}
+
+// start begins a new cycle, first draining the current one if the Statsite
+// is already running
+func (s *Statsite) start(prefix string, client Client, opts []Option) {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if s.running() {
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		err := s.shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Failed to flush statsite before re-initializing. Error: ", err)
+		}
+	}
+	if s.run != nil {
+		// Never let two flushers share the client. A flusher told to stop
+		// exits once its current write returns.
+		<-s.run.done
 	}
 
+	o := newOptions(opts)
+	r := &run{
+		queue: make(chan message, ChannelSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if o.aggregate > 0 {
+		r.aggregator = newAggregator()
+	}
+	s.randLock.Lock()
+	s.rand = rand.New(o.randSource)
+	s.randLock.Unlock()
+
+	s.l.Lock()
+	s.prefix, s.prefixErr = DefaultSanitizer.SanitizeKey(prefix)
+	s.tagFormat = o.tagFormat
+	s.run = r
+	atomic.StoreInt32(&s.state, int32(StateRunning))
+	s.l.Unlock()
+	go s.flush(client, o, r)
+}
+
+// batch is a Message made up of queued messages so that they can be written
+// to statsite in a single call
+type batch struct {
+	buf   []byte
+	count int
+}
+
+func (b *batch) String() string {
+	return string(b.buf)
+}
+
+func (b *batch) AppendTo(buf []byte) []byte {
+	return append(buf, b.buf...)
+}
+
+// send emits the batch, flushing clients that buffer, and empties the batch
+// once it has been written. A batch that could not be written is kept.
+func (b *batch) send(client Client) error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	err := client.Emit(b)
+	if err == nil {
+		if f, ok := client.(Flusher); ok {
+			err = f.Flush()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.buf = b.buf[:0]
+	b.count = 0
+	return nil
+}
+
+func (s *Statsite) flush(client Client, opts options, r *run) {
+	defer close(r.done)
+
 	var err error
+	// attempts counts the failures since a batch was last written
+	var attempts int
+	// connected is set once the first connection is made
+	var connected bool
+	// closed is set once the queue is closed and drained
+	var closed bool
+	var retry *retryBuffer
+	if opts.retryMessages > 0 || opts.retryBytes > 0 {
+		retry = newRetryBuffer(opts.retryMessages, opts.retryBytes, opts.retryPolicy)
+	}
+	b := &batch{buf: make([]byte, 0, opts.batchSize)}
+	// line is reused to encode each message before it is batched
+	var line []byte
+	encoder := encoderOf(client)
+	ticker := time.NewTicker(opts.flushInterval)
+	defer ticker.Stop()
+	var aggregateTick <-chan time.Time
+	if r.aggregator != nil {
+		aggregateTicker := time.NewTicker(opts.aggregate)
+		defer aggregateTicker.Stop()
+		aggregateTick = aggregateTicker.C
+	}
+	var statsTick <-chan time.Time
+	var lastStats Stats
+	if opts.statsInterval > 0 {
+		statsTicker := time.NewTicker(opts.statsInterval)
+		defer statsTicker.Stop()
+		statsTick = statsTicker.C
+	}
+
+	write := func() error {
+		if len(b.buf) == 0 {
+			return nil
+		}
+		size := len(b.buf)
+		err := b.send(client)
+		if err != nil {
+			atomic.AddUint64(&s.stats.writeErrors, 1)
+			return err
+		}
+		atomic.AddUint64(&s.stats.bytesSent, uint64(size))
+		attempts = 0
+		return nil
+	}
+	addLine := func(line []byte) error {
+		var err error
+		if len(b.buf) > 0 && len(b.buf)+len(line) > opts.batchSize {
+			err = write()
+		}
+		b.buf = append(b.buf, line...)
+		b.count++
+		if err == nil && len(b.buf) >= opts.batchSize {
+			err = write()
+		}
+		return err
+	}
+	add := func(m message) error {
+		line = appendMessage(encoder, line[:0], m)
+		return addLine(line)
+	}
+	// addAll adds messages to the batch, batching any left over after a
+	// failed write without writing them
+	addAll := func(messages []message) error {
+		for i, m := range messages {
+			if err := add(m); err != nil {
+				for _, m := range messages[i+1:] {
+					b.buf = appendMessage(encoder, b.buf, m)
+					b.count++
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	// discard empties a batch that could not be written, moving its lines
+	// into the retry buffer if there is one and dropping them otherwise
+	discard := func() {
+		if retry == nil {
+			atomic.AddUint64(&s.stats.droppedDisconnected, uint64(b.count))
+		} else {
+			// The batch comes before anything still held from a replay
+			var held []string
+			for retry.len() > 0 {
+				held = append(held, retry.pop())
+			}
+			dropped := 0
+			for rest := b.buf; len(rest) > 0; {
+				end := bytes.IndexByte(rest, '\n') + 1
+				if end == 0 {
+					end = len(rest)
+				}
+				dropped += retry.add(string(rest[:end]))
+				rest = rest[end:]
+			}
+			for _, line := range held {
+				dropped += retry.add(line)
+			}
+			atomic.AddUint64(&s.stats.droppedDisconnected, uint64(dropped))
+		}
+		b.buf = b.buf[:0]
+		b.count = 0
+	}
+	// track records how many messages are batched, aggregated or held for
+	// retry
+	track := func() {
+		n := b.count
+		if retry != nil {
+			n += retry.len()
+		}
+		if r.aggregator != nil {
+			n += r.aggregator.len()
+		}
+		atomic.StoreInt64(&r.pending, int64(n))
+	}
+	// abandon counts what is held for retry or aggregated as dropped when
+	// the flusher gives up
+	abandon := func() {
+		n := 0
+		if retry != nil {
+			n += retry.len()
+			retry = nil
+		}
+		if r.aggregator != nil {
+			n += len(r.aggregator.drain())
+		}
+		atomic.AddUint64(&s.stats.droppedDisconnected, uint64(n))
+	}
+	// stopped reports whether the shutdown gave up on the flusher, counting
+	// what it still holds as dropped
+	stopped := func() bool {
+		select {
+		case <-r.stop:
+		default:
+			return false
+		}
+		atomic.AddUint64(&s.stats.droppedDisconnected, uint64(b.count+len(r.queue)))
+		b.buf = b.buf[:0]
+		b.count = 0
+		abandon()
+		return true
+	}
+	defer track()
+	defer func() {
+		if err := client.Close(); err != nil {
+			log.Println("Failed to close statsite connection. Error: ", err)
+		}
+	}()
 
 Connect:
 	// Initializes a statsite client based on the toml config file
 	// Returns a statsite.Client and an error
 	// var client Client
 	err = client.Connect()
-	defer client.Close()
 
 	if err != nil {
+		if closed {
+			// Nothing more is coming and statsite is still unreachable
+			abandon()
+			return
+		}
+		goto Wait
+	}
+	if connected {
+		atomic.AddUint64(&s.stats.reconnects, 1)
+	}
+	connected = true
+
+	// Replay anything held while statsite was unreachable
+	for retry != nil && retry.len() > 0 && err == nil {
+		if stopped() {
+			return
+		}
+		err = addLine([]byte(retry.pop()))
+	}
+	if err == nil {
+		err = write()
+	}
+	if err != nil {
+		log.Println("Failed to write to statsite. Error: ", err)
+		discard()
+		if closed {
+			abandon()
+			return
+		}
 		goto Wait
 	}
+	track()
 
 	for {
-		msg, more := <-statQueue
-		if more {
-			// More stats to receive
-			err := client.Emit(msg)
-			if err != nil {
-				log.Println("Failed to write to statsite. Error: ", err)
-				goto Wait
-			}
-		} else {
-			// statQueue channel closed and all stats received, exiting
+		if stopped() {
 			return
 		}
+		select {
+		case msg, more := <-r.queue:
+			if !more {
+				// queue channel closed and all stats received, write
+				// whatever is batched or aggregated and exit
+				if r.aggregator != nil {
+					err = addAll(r.aggregator.drain())
+				}
+				if err == nil {
+					err = write()
+				}
+				if err != nil {
+					log.Println("Failed to write to statsite. Error: ", err)
+					discard()
+					if retry != nil {
+						// Make one last attempt to deliver the batch
+						// once the backoff is over
+						closed = true
+						track()
+						goto Wait
+					}
+				}
+				return
+			}
+			// More stats to receive
+			err = add(msg)
+		case <-ticker.C:
+			// Don't hold a partial batch longer than the flush interval
+			err = write()
+		case <-aggregateTick:
+			err = addAll(r.aggregator.drain())
+		case <-statsTick:
+			lastStats = s.appendStats(b, encoder, lastStats)
+		}
+		track()
+		if err != nil {
+			log.Println("Failed to write to statsite. Error: ", err)
+			discard()
+			goto Wait
+		}
 	}
 
 Wait:
-	sleep := time.After(ErrorWaitTime)
+	// Release the broken connection while waiting to reconnect
+	client.Close()
+	attempts++
+	sleep := time.After(opts.backoff.Next(attempts))
+	queue := r.queue
+	if closed {
+		queue = nil
+	}
 	for {
 		select {
-		case <-statQueue:
-			// Flush any messages sent before re-connecting
+		case msg, more := <-queue:
+			if !more {
+				// Stop reading the closed queue and make one last attempt
+				// to deliver what is held once the backoff is over
+				closed = true
+				queue = nil
+				track()
+				if atomic.LoadInt64(&r.pending) == 0 {
+					// Nothing is held, so there is nothing to wait for
+					return
+				}
+				continue
+			}
+			if retry != nil {
+				// Hold messages sent before re-connecting
+				line = appendMessage(encoder, line[:0], msg)
+				dropped := retry.add(string(line))
+				atomic.AddUint64(&s.stats.droppedDisconnected, uint64(dropped))
+				track()
+			} else {
+				atomic.AddUint64(&s.stats.droppedDisconnected, 1)
+			}
 		case <-sleep:
 			goto Connect
+		case <-r.stop:
+			stopped()
+			return
 		}
 	}
 }
 
-func enable() {
-	l.Lock()
-	enabled = true
-	publishEnabled = true
-	l.Unlock()
+// ShutdownError reports the metrics that had not been written to statsite
+// when a shutdown finished
+type ShutdownError struct {
+	// Queued is the number of messages left in the queue
+	Queued int
+	// Unflushed is the number of messages taken from the queue that were
+	// dropped or were still waiting to be written
+	Unflushed int
+	// Err is the context error if the shutdown ran out of time
+	Err error
 }
 
-func disablePublish() {
-	l.Lock()
-	publishEnabled = false
-	l.Unlock()
+func (e *ShutdownError) Error() string {
+	msg := fmt.Sprintf("statsite shutdown lost metrics: %d queued, %d unflushed", e.Queued, e.Unflushed)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
 }
 
-func disable() {
-	l.Lock()
-	enabled = false
-	l.Unlock()
+// Shutdown is used to cleanly shutdown go-statsite, flushing all metrics before
+// exiting. It gives up after ShutdownTimeout.
+func Shutdown() {
+	std.Shutdown()
 }
 
-func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	finished := make(chan struct{})
-	go func() {
-		defer close(finished)
-		wg.Wait()
-	}()
-	select {
-	case <-finished:
-		return true
-	case <-time.After(timeout):
-		return false
-	}
+// ShutdownContext is used to cleanly shutdown go-statsite, flushing all
+// metrics before returning. It returns a *ShutdownError if any metrics were
+// not written, including when ctx is done before they could be.
+func ShutdownContext(ctx context.Context) error {
+	return std.ShutdownContext(ctx)
 }
 
-// Shutdown is used to cleanly shutdown go-statsite, flushing all metrics before
-// exiting.
-func Shutdown() {
-	if !enabled {
-		return
-	}
-	// Disable publishing new metrics
-	disablePublish()
-	// Wait for all in-flight metrics to be added to the statQueue
-	waitTimeout(&publishWG, ShutdownTimeout)
-	// Close the statQueue signaling the flusher to flush all enququed metrics
+// Shutdown is used to cleanly shutdown the Statsite, flushing all metrics
+// before exiting. It gives up after ShutdownTimeout.
+func (s *Statsite) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	s.ShutdownContext(ctx)
+}
+
+// ShutdownContext is used to cleanly shutdown the Statsite, flushing all
+// metrics before returning. It returns a *ShutdownError if any metrics were
+// not written, including when ctx is done before they could be. Shutting down
+// a Statsite that is not running does nothing.
+func (s *Statsite) ShutdownContext(ctx context.Context) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	return s.shutdown(ctx)
+}
+
+func (s *Statsite) shutdown(ctx context.Context) error {
+	if !s.running() {
+		return nil
+	}
+	dropped := atomic.LoadUint64(&s.stats.droppedDisconnected)
+	// Stop publishing new metrics, waiting for all in-flight metrics to be
+	// added to the queue
+	s.l.Lock()
+	atomic.StoreInt32(&s.state, int32(StateDraining))
+	r := s.run
+	s.l.Unlock()
+	// Close the queue signaling the flusher to flush all enququed metrics
 	// and exit
-	close(statQueue)
+	close(r.queue)
 	// Wait for the flusher to flush all enqueue metrics
-	waitTimeout(&flushWG, ShutdownTimeout)
-	// Disable Flushing
-	disable()
+	var err error
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.l.Lock()
+	atomic.StoreInt32(&s.state, int32(StateStopped))
+	s.l.Unlock()
+
+	queued := len(r.queue)
+	unflushed := int(atomic.LoadInt64(&r.pending))
+	unflushed += int(atomic.LoadUint64(&s.stats.droppedDisconnected) - dropped)
+	if err != nil {
+		// Only stop the flusher once what it holds has been counted
+		close(r.stop)
+	}
+	if err != nil || queued > 0 || unflushed > 0 {
+		return &ShutdownError{
+			Queued:    queued,
+			Unflushed: unflushed,
+			Err:       err,
+		}
+	}
+	return nil
 }
@@ -1,7 +1,12 @@
 package statsite
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -28,26 +33,26 @@ func (s *LoopSuite) SetUpTest(c *C) {
 
 func (s *LoopSuite) TestInitialize(c *C) {
 	InitializeWithClient("foo.bar", s.client)
-	c.Assert(enabled, Equals, true)
+	c.Assert(std.State(), Equals, StateRunning)
 	Shutdown()
-	c.Assert(enabled, Equals, false)
+	c.Assert(std.running(), Equals, false)
 }
 
 func (s *LoopSuite) TestFlushKV(c *C) {
 	InitializeWithClient("foo.bar", s.client)
 	c.Assert(s.mockStatsite.Count(), Equals, 0)
-	c.Assert(enabled, Equals, true)
+	c.Assert(std.State(), Equals, StateRunning)
 	kv := KeyValue("loop", "test")
 	kv.Emit()
 	Shutdown()
 	c.Assert(s.mockStatsite.Count(), Equals, 1)
-	c.Assert(enabled, Equals, false)
+	c.Assert(std.running(), Equals, false)
 }
 
 func (s *LoopSuite) TestFlushKVMultiple(c *C) {
 	InitializeWithClient("foo.bar", s.client)
 	c.Assert(s.mockStatsite.Count(), Equals, 0)
-	c.Assert(enabled, Equals, true)
+	c.Assert(std.State(), Equals, StateRunning)
 	for i := 0; i < 10; i++ {
 		key := fmt.Sprintf("key%d", i)
 		kv := KeyValue(key, "value")
@@ -55,13 +60,13 @@ func (s *LoopSuite) TestFlushKVMultiple(c *C) {
 	}
 	Shutdown()
 	c.Assert(s.mockStatsite.Count(), Equals, 10)
-	c.Assert(enabled, Equals, false)
+	c.Assert(std.running(), Equals, false)
 }
 
 func (s *LoopSuite) TestShutdownNotInitialized(c *C) {
-	c.Assert(enabled, Equals, false)
+	c.Assert(std.running(), Equals, false)
 	Shutdown()
-	c.Assert(enabled, Equals, false)
+	c.Assert(std.running(), Equals, false)
 }
 
 func _DeferFlush() {
@@ -71,9 +76,311 @@ func _DeferFlush() {
 
 func (s *LoopSuite) TestFlushDefer(c *C) {
 	InitializeWithClient("foo.bar", s.client)
-	c.Assert(enabled, Equals, true)
+	c.Assert(std.State(), Equals, StateRunning)
 	_DeferFlush()
 	Shutdown()
 	c.Assert(s.mockStatsite.Count(), Equals, 1)
-	c.Assert(enabled, Equals, false)
+	c.Assert(std.running(), Equals, false)
+}
+
+func (s *LoopSuite) TestFlushBatched(c *C) {
+	InitializeWithClient("foo.bar", s.client, WithFlushInterval(time.Hour))
+	for i := 0; i < 10; i++ {
+		KeyValue(fmt.Sprintf("key%d", i), "value").Emit()
+	}
+	Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 10)
+	c.Assert(s.mockStatsite.Writes(), Equals, 1)
+}
+
+func (s *LoopSuite) TestFlushBatchSize(c *C) {
+	size := len(NewKeyValue("foo.bar.key0", "value").String())
+	InitializeWithClient("foo.bar", s.client, WithBatchSize(2*size), WithFlushInterval(time.Hour))
+	for i := 0; i < 10; i++ {
+		KeyValue(fmt.Sprintf("key%d", i), "value").Emit()
+	}
+	Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 10)
+	c.Assert(s.mockStatsite.Writes(), Equals, 5)
+}
+
+func (s *LoopSuite) TestFlushInterval(c *C) {
+	InitializeWithClient("foo.bar", s.client, WithFlushInterval(10*time.Millisecond))
+	KeyValue("loop", "test").Emit()
+	deadline := time.Now().Add(time.Second)
+	for s.mockStatsite.Count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// The partial batch is written without waiting for Shutdown
+	c.Assert(s.mockStatsite.Count(), Equals, 1)
+	Shutdown()
+}
+
+func (s *LoopSuite) TestInstances(c *C) {
+	other := &mockStatsite{}
+	network := NewMockNetwork(map[string]mockServer{"other": other})
+	first := New("first", s.client)
+	second := New("second", NewNetworkClient("other", network))
+	first.Counter("hits").Emit()
+	second.Gauge("load").Emit()
+	c.Assert(std.running(), Equals, false)
+	first.Shutdown()
+	second.Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 1)
+	c.Assert(s.mockStatsite.Last(), Equals, "first.hits:0|c\n")
+	c.Assert(other.Count(), Equals, 1)
+	c.Assert(other.Last(), Equals, "second.load:0|g\n")
+}
+
+func (s *LoopSuite) TestInstanceNotStarted(c *C) {
+	st := &Statsite{}
+	st.KeyValue("loop", "test").Emit()
+	st.Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 0)
+}
+
+func (s *LoopSuite) TestFlushTagged(c *C) {
+	InitializeWithClient("foo.bar", s.client, WithTagFormat(TagsDogStatsD))
+	Counter("hits").Tag("region", "us").Emit()
+	Shutdown()
+	c.Assert(s.mockStatsite.Last(), Equals, "foo.bar.hits:0|c|#region:us\n")
+}
+
+func (s *LoopSuite) TestFlushSampled(c *C) {
+	InitializeWithClient("foo.bar", s.client, WithRandSource(rand.NewSource(42)))
+	for i := 0; i < 1000; i++ {
+		SampledCounter("hits", 0.1).Emit()
+	}
+	Shutdown()
+
+	expected := 0
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 1000; i++ {
+		if r.Float64() < 0.1 {
+			expected++
+		}
+	}
+	c.Assert(s.mockStatsite.Count(), Equals, expected)
+	c.Assert(s.mockStatsite.Last(), Equals, "foo.bar.hits:0|c|@0.1\n")
+}
+
+func (s *LoopSuite) TestFlushSampledNever(c *C) {
+	InitializeWithClient("foo.bar", s.client)
+	SampledCounter("hits", 0).Emit()
+	SampledCounter("hits", -1).Emit()
+	SampledTimer("time", 0).Emit()
+	Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 0)
+}
+
+func (s *LoopSuite) TestShutdownContext(c *C) {
+	InitializeWithClient("foo.bar", s.client)
+	KeyValue("loop", "test").Emit()
+	err := ShutdownContext(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(s.mockStatsite.Count(), Equals, 1)
+}
+
+func (s *LoopSuite) TestShutdownContextUnreachable(c *C) {
+	st := New("foo.bar", NewNetworkClient("badconnection", s.mockNetwork),
+		WithBackoff(ConstantBackoff(time.Hour)),
+		WithRetryBuffer(10, 0, DropOldest),
+	)
+	st.KeyValue("a", "1").Emit()
+	st.KeyValue("b", "2").Emit()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := st.ShutdownContext(ctx)
+	c.Assert(err, FitsTypeOf, &ShutdownError{})
+	shutdownErr := err.(*ShutdownError)
+	c.Assert(shutdownErr.Err, Equals, context.DeadlineExceeded)
+	c.Assert(shutdownErr.Queued+shutdownErr.Unflushed, Equals, 2)
+	c.Assert(err, ErrorMatches, "statsite shutdown lost metrics: .*: context deadline exceeded")
+}
+
+func (s *LoopSuite) TestShutdownContextGivesUp(c *C) {
+	st := New("foo.bar", NewNetworkClient("badconnection", s.mockNetwork),
+		WithBackoff(ConstantBackoff(time.Millisecond)),
+		WithRetryBuffer(10, 0, DropOldest),
+	)
+	st.KeyValue("a", "1").Emit()
+	st.KeyValue("b", "2").Emit()
+	err := st.ShutdownContext(context.Background())
+	c.Assert(err, DeepEquals, &ShutdownError{Unflushed: 2})
+}
+
+func (s *LoopSuite) TestShutdownUnreachableNothingHeld(c *C) {
+	st := New("foo.bar", NewNetworkClient("badconnection", s.mockNetwork),
+		WithBackoff(ConstantBackoff(time.Hour)),
+	)
+	st.KeyValue("a", "1").Emit()
+	st.KeyValue("b", "2").Emit()
+	// Nothing is held for retry, so shutting down does not wait out the
+	// backoff
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := st.ShutdownContext(ctx)
+	c.Assert(err, DeepEquals, &ShutdownError{Unflushed: 2})
+}
+
+func (s *LoopSuite) TestReinitializeAfterShutdownGivesUp(c *C) {
+	client := NewNetworkClient("badconnection", s.mockNetwork)
+	opts := []Option{
+		WithBackoff(ConstantBackoff(200 * time.Millisecond)),
+		WithRetryBuffer(10, 0, DropOldest),
+	}
+	st := New("foo.bar", client, opts...)
+	st.KeyValue("a", "1").Emit()
+	first := st.run
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(st.ShutdownContext(ctx), NotNil)
+	// The flusher left waiting to reconnect must be gone before the client
+	// is handed to the next one
+	st.start("foo.bar", client, opts)
+	select {
+	case <-first.done:
+	default:
+		c.Fatal("started a second flusher on the same client")
+	}
+	st.KeyValue("b", "2").Emit()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(st.ShutdownContext(ctx), NotNil)
+}
+
+func (s *LoopSuite) TestSanitized(c *C) {
+	st := New("my app", s.client, WithTagFormat(TagsDogStatsD))
+	st.CounterAt("hits", 1).Tag("env", "prod,evil").Emit()
+	st.Shutdown()
+	c.Assert(s.mockStatsite.Read(), DeepEquals, []string{"my_app.hits:1|c|#env:prod_evil\n"})
+}
+
+func (s *LoopSuite) TestPrefixRejected(c *C) {
+	defer func(sanitizer Sanitizer) { DefaultSanitizer = sanitizer }(DefaultSanitizer)
+	DefaultSanitizer = RejectSanitizer{}
+	st := New("my app", s.client, WithStatsInterval(time.Millisecond))
+	st.CounterAt("hits", 1).Emit()
+	// Let the stats be emitted, which would carry the rejected prefix
+	time.Sleep(20 * time.Millisecond)
+	st.Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 0)
+	c.Assert(st.Stats().DroppedInvalid, Equals, uint64(1))
+}
+
+func (s *LoopSuite) TestLifecycle(c *C) {
+	st := &Statsite{}
+	c.Assert(st.State(), Equals, StateUninitialized)
+	c.Assert(st.ShutdownContext(context.Background()), IsNil)
+	st.start("foo.bar", s.client, nil)
+	c.Assert(st.State(), Equals, StateRunning)
+	st.KeyValue("first", "1").Emit()
+	// Starting again drains the running cycle first
+	st.start("foo.baz", s.client, nil)
+	c.Assert(st.State(), Equals, StateRunning)
+	st.KeyValue("second", "2").Emit()
+	c.Assert(st.ShutdownContext(context.Background()), IsNil)
+	c.Assert(st.State(), Equals, StateStopped)
+	// Shutting down twice is a no-op
+	c.Assert(st.ShutdownContext(context.Background()), IsNil)
+	st.KeyValue("third", "3").Emit()
+	c.Assert(s.mockStatsite.Read(), DeepEquals, []string{"foo.bar.first:1|kv\n", "foo.baz.second:2|kv\n"})
+}
+
+func (s *LoopSuite) TestReinitializeConcurrently(c *C) {
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					Counter("hits").Emit()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		InitializeWithClient("foo.bar", NewNetworkClient("statsite", s.mockNetwork))
+		if i%2 == 0 {
+			// Odd iterations re-initialize while running
+			Shutdown()
+			Shutdown()
+		}
+	}
+	Shutdown()
+	close(stop)
+	wg.Wait()
+	c.Assert(std.State(), Equals, StateStopped)
+}
+
+func (s *LoopSuite) TestHistogramNotRunning(c *C) {
+	st := &Statsite{}
+	h := st.Histogram("size")
+	for i := 0; i < 1000; i++ {
+		h.Observe(1)
+		h.Emit()
+	}
+	// Values emitted while metrics are off are not held on to
+	c.Assert(h.values, HasLen, 0)
+}
+
+func (s *LoopSuite) TestFlushHistogram(c *C) {
+	InitializeWithClient("foo.bar", s.client)
+	h := Histogram("size")
+	h.Observe(1)
+	h.Observe(2.5)
+	h.Emit()
+	// Observations are only sent once
+	h.Emit()
+	d := Distribution("latency").Tag("region", "us")
+	d.Observe(0.25)
+	d.Emit()
+	Shutdown()
+	lines := s.mockStatsite.Read()
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{
+		"foo.bar.latency.region.us:0.25|d\n",
+		"foo.bar.size:1|h\n",
+		"foo.bar.size:2.5|h\n",
+	})
+}
+
+func (s *LoopSuite) TestFlushGaugeFloat(c *C) {
+	InitializeWithClient("foo.bar", s.client)
+	g := GaugeFloat("load", 0.5)
+	g.IncrBy(1)
+	g.Emit()
+	GaugeAt("count", 2).Emit()
+	Shutdown()
+	lines := s.mockStatsite.Read()
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{"foo.bar.count:2|g\n", "foo.bar.load:1.5|g\n"})
+}
+
+func (s *LoopSuite) TestFlushGaugeDelta(c *C) {
+	InitializeWithClient("foo.bar", s.client, WithBatchSize(0))
+	g := GaugeDelta("workers", 1)
+	g.IncrBy(2)
+	g.Emit()
+	g.EmitDelta(-1)
+	Shutdown()
+	lines := s.mockStatsite.Read()
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{"foo.bar.workers:+3|g\n", "foo.bar.workers:-1|g\n"})
+}
+
+func (s *LoopSuite) TestFlushNegativeGauge(c *C) {
+	InitializeWithClient("foo.bar", s.client)
+	GaugeAt("temp", -5).Emit()
+	GaugeFloat("level", -0.5).Emit()
+	Shutdown()
+	c.Assert(s.mockStatsite.Read(), DeepEquals, []string{
+		"foo.bar.temp:0|g\n", "foo.bar.temp:-5|g\n",
+		"foo.bar.level:0|g\n", "foo.bar.level:-0.5|g\n",
+	})
 }
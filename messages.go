@@ -1,51 +1,340 @@
 package statsite
 
 import (
-	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	MESSAGE_FORMAT = "%v:%v|%v\n"
 
-	TYPE_KEY_VALUE = MessageType("kv") // - Simple Key/Value
-	TYPE_GAUGE     = MessageType("g")  // - Same as kv, compatibility with statsd gauges
-	TYPE_TIMER     = MessageType("ms") // - Timer
-	TYPE_COUNTER   = MessageType("c")  // - Counter
-	TYPE_SET       = MessageType("s")  // - Unique Set
+	TYPE_KEY_VALUE    = MessageType("kv") // - Simple Key/Value
+	TYPE_GAUGE        = MessageType("g")  // - Same as kv, compatibility with statsd gauges
+	TYPE_TIMER        = MessageType("ms") // - Timer
+	TYPE_COUNTER      = MessageType("c")  // - Counter
+	TYPE_SET          = MessageType("s")  // - Unique Set
+	TYPE_HISTOGRAM    = MessageType("h")  // - Histogram
+	TYPE_DISTRIBUTION = MessageType("d")  // - Distribution, for DogStatsD compatible backends
 )
 
 type MessageType string
 
+// FloatPrecision is the number of digits after the decimal point used for
+// floating-point values. The default of -1 uses the fewest digits needed to
+// represent the value exactly. Values are never written in scientific
+// notation, which statsite does not accept.
+var FloatPrecision = -1
+
+// formatFloat formats a floating-point value using FloatPrecision
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', FloatPrecision, 64)
+}
+
+// TagFormat selects how the tags of a message are encoded
+type TagFormat int
+
+const (
+	// TagsInKey folds tags into the key as key.tag.value for plain statsite
+	TagsInKey TagFormat = iota
+	// TagsDogStatsD appends tags to the line as |#tag:value,tag:value
+	TagsDogStatsD
+	// TagsInflux appends tags to the key as key,tag=value,tag=value
+	TagsInflux
+)
+
+// Tag is a dimension attached to a message
+type Tag struct {
+	Key   string
+	Value string
+}
+
 type Message interface {
 	String() string
+	// AppendTo appends the encoded message to buf and returns the extended
+	// buffer, so that messages can be encoded without allocating
+	AppendTo(buf []byte) []byte
 }
 
+// valueKind says which field holds the value of a message. Metrics keep
+// numbers unformatted until the message is encoded.
+type valueKind uint8
+
+const (
+	valueString valueKind = iota
+	valueInt
+	valueFloat
+)
+
 type message struct {
-	Key   string
-	Value string
-	Type  MessageType
+	// Prefix is written before Key, separated by a '.', when it is set
+	Prefix string
+	Key    string
+	Value  string
+	Type   MessageType
+	Tags   []Tag
+	Format TagFormat
+	// Rate is the sample rate the message was sent at, between 0 and 1. A
+	// Rate of 0 or 1 means the message was not sampled.
+	Rate float64
+	// err is why the DefaultSanitizer rejected the message. A rejected
+	// message is never sent.
+	err error
+
+	kind       valueKind
+	intValue   int64
+	floatValue float64
+	// delta marks a numeric gauge value as a signed delta
+	delta bool
+}
+
+// newMessage creates a message with its key and value passed through the
+// DefaultSanitizer
+func newMessage(key, value string, typ MessageType) *message {
+	m := &message{Type: typ}
+	m.Key, m.err = DefaultSanitizer.SanitizeKey(key)
+	if m.err == nil {
+		m.Value, m.err = DefaultSanitizer.SanitizeValue(value)
+	}
+	return m
 }
 
 func (m message) String() string {
-	return fmt.Sprintf(MESSAGE_FORMAT, m.Key, m.Value, m.Type)
+	return string(m.AppendTo(nil))
 }
 
-func NewKeyValue(key, value string) Message {
-	return &message{
-		Key:   key,
-		Value: value,
-		Type:  TYPE_KEY_VALUE,
+// AppendTo appends the message in the statsite line protocol to buf
+func (m message) AppendTo(buf []byte) []byte {
+	if m.err != nil {
+		return buf
+	}
+	if m.Type == TYPE_GAUGE && !m.delta && m.negative() {
+		// statsite reads a leading '-' as a delta, so a negative value is
+		// set by zeroing the gauge first
+		zero := m
+		zero.kind = valueInt
+		zero.intValue = 0
+		buf = zero.appendLine(buf)
+	}
+	return m.appendLine(buf)
+}
+
+// appendLine appends the message to buf as a single line
+func (m message) appendLine(buf []byte) []byte {
+	if m.Prefix != "" {
+		buf = append(buf, m.Prefix...)
+		buf = append(buf, '.')
+	}
+	buf = append(buf, m.Key...)
+	if len(m.Tags) > 0 {
+		switch m.Format {
+		case TagsInflux:
+			for _, tag := range m.Tags {
+				if tag.Value == "" {
+					// Influx has no tags without values
+					continue
+				}
+				buf = append(buf, ',')
+				buf = appendInfluxEscaped(buf, tag.Key)
+				buf = append(buf, '=')
+				buf = appendInfluxEscaped(buf, tag.Value)
+			}
+		case TagsInKey:
+			for _, tag := range m.Tags {
+				buf = append(buf, '.')
+				buf = append(buf, tag.Key...)
+				if tag.Value != "" {
+					buf = append(buf, '.')
+					buf = append(buf, tag.Value...)
+				}
+			}
+		}
+	}
+	buf = append(buf, ':')
+	buf = m.appendValue(buf)
+	buf = append(buf, '|')
+	buf = append(buf, m.Type...)
+	if m.sampled() {
+		buf = append(buf, "|@"...)
+		buf = strconv.AppendFloat(buf, m.Rate, 'f', -1, 64)
+	}
+	if len(m.Tags) > 0 && m.Format == TagsDogStatsD {
+		buf = append(buf, "|#"...)
+		for i, tag := range m.Tags {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendDogStatsDTag(buf, tag.Key)
+			if tag.Value != "" {
+				buf = append(buf, ':')
+				buf = appendDogStatsDTag(buf, tag.Value)
+			}
+		}
+	}
+	return append(buf, '\n')
+}
+
+// appendDogStatsDTag appends the key or value of a tag with the characters
+// that would start another tag, value or section replaced by an underscore,
+// since DogStatsD has no escaping
+func appendDogStatsDTag(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(",#:|", s[i]) >= 0 {
+			buf = append(buf, '_')
+		} else {
+			buf = append(buf, s[i])
+		}
+	}
+	return buf
+}
+
+// appendValue appends the formatted value of the message to buf
+func (m message) appendValue(buf []byte) []byte {
+	switch m.kind {
+	case valueInt:
+		if m.delta && m.intValue >= 0 {
+			buf = append(buf, '+')
+		}
+		return strconv.AppendInt(buf, m.intValue, 10)
+	case valueFloat:
+		if m.delta && !math.Signbit(m.floatValue) {
+			buf = append(buf, '+')
+		}
+		return strconv.AppendFloat(buf, m.floatValue, 'f', FloatPrecision, 64)
+	}
+	return append(buf, m.Value...)
+}
+
+// isDelta reports whether the message is a gauge delta
+func (m message) isDelta() bool {
+	return m.delta
+}
+
+// negative reports whether the value of the message is below zero
+func (m message) negative() bool {
+	switch m.kind {
+	case valueInt:
+		return m.intValue < 0
+	case valueFloat:
+		return math.Signbit(m.floatValue)
+	}
+	return len(m.Value) > 0 && m.Value[0] == '-'
+}
+
+// number returns the value of the message as a float
+func (m message) number() (float64, error) {
+	switch m.kind {
+	case valueInt:
+		return float64(m.intValue), nil
+	case valueFloat:
+		return m.floatValue, nil
+	}
+	return strconv.ParseFloat(m.Value, 64)
+}
+
+// integer returns the value of the message if it is an integer
+func (m message) integer() (int64, bool) {
+	switch m.kind {
+	case valueInt:
+		return m.intValue, true
+	case valueFloat:
+		return 0, false
+	}
+	n, err := strconv.ParseInt(m.Value, 10, 64)
+	return n, err == nil
+}
+
+// sampled reports whether the message was sent at a sample rate below 1
+func (m message) sampled() bool {
+	return m.Rate > 0 && m.Rate < 1
+}
+
+// Tagged returns a copy of msg with tags added, encoded using format. Only
+// messages created by this package can carry tags; any other Message is
+// returned unchanged.
+func Tagged(msg Message, format TagFormat, tags ...Tag) Message {
+	m, ok := msg.(*message)
+	if !ok || len(tags) == 0 {
+		return msg
+	}
+	tagged := *m
+	tagged.Tags = append([]Tag(nil), m.Tags...)
+	for _, tag := range tags {
+		var err error
+		if tag.Key, err = DefaultSanitizer.SanitizeKey(tag.Key); err == nil {
+			tag.Value, err = DefaultSanitizer.SanitizeKey(tag.Value)
+		}
+		if err != nil && tagged.err == nil {
+			tagged.err = err
+		}
+		tagged.Tags = append(tagged.Tags, tag)
 	}
+	tagged.Format = format
+	return &tagged
+}
+
+// Checked returns msg along with the error explaining why the
+// DefaultSanitizer rejected it, if it did. Wrapping a constructor, as in
+// Checked(NewCounter(key, 1)), gives an error-returning variant of it.
+// Rejected messages are never sent.
+func Checked(msg Message) (Message, error) {
+	if m, ok := msg.(*message); ok && m.err != nil {
+		return msg, m.err
+	}
+	return msg, nil
+}
+
+// Sampled returns a copy of msg marked as sent at the given sample rate, so
+// that statsite scales its value back up. Only messages created by this
+// package can be sampled; any other Message is returned unchanged.
+func Sampled(msg Message, rate float64) Message {
+	m, ok := msg.(*message)
+	if !ok {
+		return msg
+	}
+	sampled := *m
+	sampled.Rate = rate
+	return &sampled
+}
+
+func NewKeyValue(key, value string) Message {
+	return newMessage(key, value, TYPE_KEY_VALUE)
 }
 
 func NewGauge(key string, value int) Message {
-	return &message{
-		Key:   key,
-		Value: strconv.FormatInt(int64(value), 10),
-		Type:  TYPE_GAUGE,
+	return newMessage(key, strconv.FormatInt(int64(value), 10), TYPE_GAUGE)
+}
+
+func NewGaugeFloat(key string, value float64) Message {
+	return newMessage(key, formatFloat(value), TYPE_GAUGE)
+}
+
+// NewGaugeDelta adjusts the current value of a gauge by delta rather than
+// replacing it, so that several processes can update the same gauge
+func NewGaugeDelta(key string, delta int) Message {
+	m := newMessage(key, signed(strconv.FormatInt(int64(delta), 10)), TYPE_GAUGE)
+	m.delta = true
+	return m
+}
+
+// NewGaugeDeltaFloat is NewGaugeDelta with a floating-point delta
+func NewGaugeDeltaFloat(key string, delta float64) Message {
+	m := newMessage(key, signed(formatFloat(delta)), TYPE_GAUGE)
+	m.delta = true
+	return m
+}
+
+// signed adds the + sign that marks a positive gauge value as a delta
+func signed(value string) string {
+	if len(value) > 0 && value[0] == '-' {
+		return value
 	}
+	return "+" + value
+}
+
+func NewKeyValueFloat(key string, value float64) Message {
+	return NewKeyValue(key, formatFloat(value))
 }
 
 func NewTimer(key string, start, end time.Time) Message {
@@ -58,11 +347,19 @@ func NewTimerNow(key string, previous time.Time) Message {
 
 func NewTimerDuration(key string, duration time.Duration) Message {
 	value := int64(duration / time.Millisecond)
-	return &message{
-		Key:   key,
-		Value: strconv.FormatInt(value, 10),
-		Type:  TYPE_TIMER,
-	}
+	return newMessage(key, strconv.FormatInt(value, 10), TYPE_TIMER)
+}
+
+// NewTimerFloat is NewTimer with fractions of a millisecond
+func NewTimerFloat(key string, start, end time.Time) Message {
+	return NewTimerDurationFloat(key, end.Sub(start))
+}
+
+// NewTimerDurationFloat is NewTimerDuration with fractions of a millisecond,
+// so that 250µs is reported as 0.25
+func NewTimerDurationFloat(key string, duration time.Duration) Message {
+	value := float64(duration) / float64(time.Millisecond)
+	return newMessage(key, formatFloat(value), TYPE_TIMER)
 }
 
 func NewCounter(key string, value int) Message {
@@ -70,21 +367,21 @@ func NewCounter(key string, value int) Message {
 }
 
 func NewCounter64(key string, value int64) Message {
-	return &message{
-		Key:   key,
-		Value: strconv.FormatInt(value, 10),
-		Type:  TYPE_COUNTER,
-	}
+	return newMessage(key, strconv.FormatInt(value, 10), TYPE_COUNTER)
 }
 
 func NewSet(key, value string) Message {
-	return &message{
-		Key:   key,
-		Value: value,
-		Type:  TYPE_SET,
-	}
+	return newMessage(key, value, TYPE_SET)
 }
 
 func NewSetInt(key string, value int) Message {
 	return NewSet(key, strconv.FormatInt(int64(value), 10))
 }
+
+func NewHistogram(key string, value float64) Message {
+	return newMessage(key, formatFloat(value), TYPE_HISTOGRAM)
+}
+
+func NewDistribution(key string, value float64) Message {
+	return newMessage(key, formatFloat(value), TYPE_DISTRIBUTION)
+}
@@ -18,7 +18,7 @@ func TestMessage(t *testing.T) {
 	val := "bar"
 	typ := TYPE_KEY_VALUE
 
-	m := message{key, val, typ}
+	m := message{Key: key, Value: val, Type: typ}
 
 	Assert(t, key, m.Key)
 	Assert(t, val, m.Value)
@@ -124,3 +124,164 @@ func TestSetIntMessage(t *testing.T) {
 	Assert(t, strconv.FormatInt(10, 10), m.Value)
 	Assert(t, TYPE_SET, m.Type)
 }
+
+func TestTaggedMessage(t *testing.T) {
+	tags := []Tag{{"region", "us"}, {"canary", ""}}
+	m := NewCounter("foo", 10)
+
+	Assert(t, "foo.region.us.canary:10|c\n", Tagged(m, TagsInKey, tags...).String())
+	Assert(t, "foo:10|c|#region:us,canary\n", Tagged(m, TagsDogStatsD, tags...).String())
+	Assert(t, "foo,region=us:10|c\n", Tagged(m, TagsInflux, tags...).String())
+	// The original message is left untouched
+	Assert(t, "foo:10|c\n", m.String())
+}
+
+func TestTaggedAppends(t *testing.T) {
+	m := Tagged(NewGauge("foo", 1), TagsDogStatsD, Tag{"a", "1"})
+	m = Tagged(m, TagsDogStatsD, Tag{"b", "2"})
+
+	Assert(t, "foo:1|g|#a:1,b:2\n", m.String())
+	Assert(t, 2, len(m.(*message).Tags))
+}
+
+func TestSampledMessage(t *testing.T) {
+	m := NewCounter("foo", 10)
+
+	Assert(t, "foo:10|c|@0.25\n", Sampled(m, 0.25).String())
+	Assert(t, "foo:10|c\n", Sampled(m, 1).String())
+	Assert(t, "foo:10|c|@0.5|#a:1\n", Sampled(Tagged(m, TagsDogStatsD, Tag{"a", "1"}), 0.5).String())
+}
+
+func TestHistogramMessage(t *testing.T) {
+	m := NewHistogram("foo", 1.5).(*message)
+
+	Assert(t, "foo", m.Key)
+	Assert(t, "1.5", m.Value)
+	Assert(t, TYPE_HISTOGRAM, m.Type)
+	Assert(t, "foo:1.5|h\n", m.String())
+}
+
+func TestDistributionMessage(t *testing.T) {
+	m := NewDistribution("foo", 0.000001).(*message)
+
+	Assert(t, "foo", m.Key)
+	Assert(t, "0.000001", m.Value)
+	Assert(t, TYPE_DISTRIBUTION, m.Type)
+}
+
+func TestTimerDurationFloatMessage(t *testing.T) {
+	m := NewTimerDurationFloat("foo", 250*time.Microsecond).(*message)
+
+	Assert(t, "0.25", m.Value)
+	Assert(t, TYPE_TIMER, m.Type)
+	Assert(t, "foo:0.25|ms\n", m.String())
+	Assert(t, "60000", NewTimerDurationFloat("foo", time.Minute).(*message).Value)
+	Assert(t, "0.000001", NewTimerDurationFloat("foo", time.Nanosecond).(*message).Value)
+}
+
+func TestGaugeFloatMessage(t *testing.T) {
+	m := NewGaugeFloat("foo", 1e21).(*message)
+
+	// Large and small values are never written in scientific notation
+	Assert(t, "1000000000000000000000", m.Value)
+	Assert(t, TYPE_GAUGE, m.Type)
+	Assert(t, "0.0000001", NewGaugeFloat("foo", 1e-7).(*message).Value)
+}
+
+func TestKeyValueFloatMessage(t *testing.T) {
+	m := NewKeyValueFloat("foo", 2.5).(*message)
+
+	Assert(t, "2.5", m.Value)
+	Assert(t, TYPE_KEY_VALUE, m.Type)
+}
+
+func TestFloatPrecision(t *testing.T) {
+	defer func(precision int) { FloatPrecision = precision }(FloatPrecision)
+	FloatPrecision = 2
+
+	Assert(t, "3.14", NewGaugeFloat("foo", 3.14159).(*message).Value)
+	Assert(t, "0.25", NewTimerDurationFloat("foo", 250*time.Microsecond).(*message).Value)
+	Assert(t, "1.00", NewHistogram("foo", 1).(*message).Value)
+}
+
+func TestGaugeDeltaMessage(t *testing.T) {
+	Assert(t, "foo:+5|g\n", NewGaugeDelta("foo", 5).String())
+	Assert(t, "foo:-3|g\n", NewGaugeDelta("foo", -3).String())
+	Assert(t, "foo:+0|g\n", NewGaugeDelta("foo", 0).String())
+	Assert(t, "foo:+0.5|g\n", NewGaugeDeltaFloat("foo", 0.5).String())
+	Assert(t, "foo:-0.5|g\n", NewGaugeDeltaFloat("foo", -0.5).String())
+}
+
+func TestNegativeGaugeMessage(t *testing.T) {
+	// statsite would apply -5 as a delta, so the gauge is zeroed first
+	Assert(t, "foo:0|g\nfoo:-5|g\n", NewGauge("foo", -5).String())
+	Assert(t, "foo:0|g\nfoo:-0.5|g\n", NewGaugeFloat("foo", -0.5).String())
+	Assert(t, false, NewGauge("foo", -5).(*message).isDelta())
+	Assert(t, true, NewGaugeDelta("foo", -5).(*message).isDelta())
+}
+
+func TestAppendToAllocs(t *testing.T) {
+	m := Tagged(NewCounter("foo", 1), TagsDogStatsD, Tag{"a", "b"})
+	buf := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = m.AppendTo(buf[:0])
+	})
+	Assert(t, 0.0, allocs)
+	Assert(t, m.String(), string(buf))
+}
+
+// discardClient encodes messages the way a real client does without writing
+// them anywhere
+type discardClient struct {
+	buf []byte
+}
+
+func (t *discardClient) Connect() error  { return nil }
+func (t *discardClient) Close() error    { return nil }
+func (t *discardClient) Connected() bool { return true }
+
+func (t *discardClient) Emit(msg Message) error {
+	t.buf = msg.AppendTo(t.buf[:0])
+	return nil
+}
+
+func TestEmitAllocs(t *testing.T) {
+	s := New("foo", &discardClient{})
+	defer s.Shutdown()
+	c := s.CounterAt("counter", 1).Tag("a", "b")
+	allocs := testing.AllocsPerRun(1000, c.Emit)
+	Assert(t, 0.0, allocs)
+}
+
+func BenchmarkMessageAppendTo(b *testing.B) {
+	m := Tagged(NewTimerDurationFloat("foo", 250*time.Microsecond), TagsDogStatsD, Tag{"a", "b"})
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = m.AppendTo(buf[:0])
+	}
+}
+
+// BenchmarkMessageString measures the allocating encoding for comparison
+func BenchmarkMessageString(b *testing.B) {
+	m := Tagged(NewTimerDurationFloat("foo", 250*time.Microsecond), TagsDogStatsD, Tag{"a", "b"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m.String()
+	}
+}
+
+// BenchmarkEmitEncoded measures a steady-state Emit through to the encoded
+// line that a client writes
+func BenchmarkEmitEncoded(b *testing.B) {
+	s := New("foo", &discardClient{})
+	defer s.Shutdown()
+	c := s.CounterAt("counter", 1).Tag("a", "b")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Emit()
+	}
+}
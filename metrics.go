@@ -1,67 +1,175 @@
 package statsite
 
 import (
-	"fmt"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var publishWG sync.WaitGroup
-var publishEnabled bool = false
-
 // Metric represents a statsite metric
 type Metric interface {
 	Emit()
 }
 
-func publish(message Message) {
-	defer publishWG.Done()
+// publish hands a message to the aggregator, if it takes it, or else adds it
+// to the queue without blocking. The read lock keeps Shutdown from closing
+// the queue until the message has been added.
+func (s *Statsite) publish(m message) {
+	if m.err != nil {
+		// The DefaultSanitizer rejected the message
+		atomic.AddUint64(&s.stats.droppedInvalid, 1)
+		return
+	}
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if !s.running() {
+		return
+	}
+	if s.prefixErr != nil {
+		atomic.AddUint64(&s.stats.droppedInvalid, 1)
+		return
+	}
+	m.Prefix = s.prefix
+	m.Format = s.tagFormat
+	if s.run.aggregator != nil && s.run.aggregator.add(m) {
+		atomic.AddUint64(&s.stats.enqueued, 1)
+		return
+	}
 	select {
-	case statQueue <- message:
+	case s.run.queue <- m:
+		atomic.AddUint64(&s.stats.enqueued, 1)
 	default:
 		// Channel is full so we are dropping metric
+		atomic.AddUint64(&s.stats.droppedQueueFull, 1)
+	}
+}
+
+// sample reports whether a metric sampled at rate should be emitted this time.
+// A rate of 0 or less is never emitted.
+func (s *Statsite) sample(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
 	}
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	return s.rand.Float64() < rate
+}
+
+// metric holds what every metric needs to build its messages. The key and
+// tags are sanitized once, when they are set, rather than on every Emit.
+type metric struct {
+	s    *Statsite
+	key  string
+	tags []Tag
+	err  error
+}
+
+func newMetric(s *Statsite, key string) metric {
+	m := metric{s: s}
+	m.key, m.err = DefaultSanitizer.SanitizeKey(key)
+	return m
+}
+
+// tag adds a sanitized tag to the metric
+func (t *metric) tag(key, value string) {
+	var err error
+	if key, err = DefaultSanitizer.SanitizeKey(key); err == nil {
+		value, err = DefaultSanitizer.SanitizeKey(value)
+	}
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	t.tags = append(t.tags, Tag{key, value})
+}
+
+// message returns a message of type typ for the metric, without a value
+func (t *metric) message(typ MessageType) message {
+	return message{Key: t.key, Type: typ, Tags: t.tags, err: t.err}
 }
 
 // Timer Metric
 // t := Timer(key)
 // defer t.Emit()
 type timer struct {
+	metric
 	start time.Time
-	key   string
+	rate  float64
 }
 
 func Timer(key string) *timer {
-	return &timer{time.Now(), key}
+	return std.Timer(key)
+}
+
+func (s *Statsite) Timer(key string) *timer {
+	return &timer{newMetric(s, key), time.Now(), 1}
+}
+
+// SampledTimer is a Timer that is only emitted for the given fraction of
+// calls to Emit. Statsite scales the sampled timings back up. A rate of 0 or
+// less is never emitted.
+func SampledTimer(key string, rate float64) *timer {
+	return std.SampledTimer(key, rate)
+}
+
+func (s *Statsite) SampledTimer(key string, rate float64) *timer {
+	return &timer{newMetric(s, key), time.Now(), rate}
+}
+
+// Tag adds a tag to the timer
+func (t *timer) Tag(key, value string) *timer {
+	t.tag(key, value)
+	return t
 }
 
 func (t *timer) Emit() {
-	if !publishEnabled {
+	if !t.s.running() || !t.s.sample(t.rate) {
 		return
 	}
-	timer := NewTimer(
-		fmt.Sprintf("%s.%s", metricPrefix, t.key),
-		t.start,
-		time.Now(),
-	)
-	publishWG.Add(1)
-	go publish(timer)
+	m := t.message(TYPE_TIMER)
+	m.kind = valueFloat
+	m.floatValue = float64(time.Now().Sub(t.start)) / float64(time.Millisecond)
+	if t.rate < 1 {
+		m.Rate = t.rate
+	}
+	t.s.publish(m)
 }
 
 // Counter Metric
 // t := Timer(key)
 // defer t.Emit()
 type counter struct {
-	key   string
+	metric
 	count int
+	rate  float64
 }
 
 func Counter(key string) *counter {
-	return &counter{key, 0}
+	return std.Counter(key)
+}
+
+func (s *Statsite) Counter(key string) *counter {
+	return &counter{newMetric(s, key), 0, 1}
 }
 
 func CounterAt(key string, i int) *counter {
-	return &counter{key, i}
+	return std.CounterAt(key, i)
+}
+
+func (s *Statsite) CounterAt(key string, i int) *counter {
+	return &counter{newMetric(s, key), i, 1}
+}
+
+// SampledCounter is a Counter that is only emitted for the given fraction of
+// calls to Emit. Statsite scales the sampled counts back up. A rate of 0 or
+// less is never emitted.
+func SampledCounter(key string, rate float64) *counter {
+	return std.SampledCounter(key, rate)
+}
+
+func (s *Statsite) SampledCounter(key string, rate float64) *counter {
+	return &counter{newMetric(s, key), 0, rate}
 }
 
 func (t *counter) Incr() {
@@ -72,14 +180,24 @@ func (t *counter) IncrBy(i int) {
 	t.count += i
 }
 
+// Tag adds a tag to the counter
+func (t *counter) Tag(key, value string) *counter {
+	t.tag(key, value)
+	return t
+}
+
 func (t *counter) Emit() {
-	if !publishEnabled {
+	if !t.s.running() || !t.s.sample(t.rate) {
 		return
 	}
 
-	counter := NewCounter(fmt.Sprintf("%s.%s", metricPrefix, t.key), t.count)
-	publishWG.Add(1)
-	go publish(counter)
+	m := t.message(TYPE_COUNTER)
+	m.kind = valueInt
+	m.intValue = int64(t.count)
+	if t.rate < 1 {
+		m.Rate = t.rate
+	}
+	t.s.publish(m)
 }
 
 type timerCounter struct {
@@ -88,16 +206,24 @@ type timerCounter struct {
 }
 
 func TimerCounter(key string) *timerCounter {
+	return std.TimerCounter(key)
+}
+
+func (s *Statsite) TimerCounter(key string) *timerCounter {
 	return &timerCounter{
-		Timer(key),
-		CounterAt(key, 1),
+		s.Timer(key),
+		s.CounterAt(key, 1),
 	}
 }
 
 func TimerCounterAt(key string, i int) *timerCounter {
+	return std.TimerCounterAt(key, i)
+}
+
+func (s *Statsite) TimerCounterAt(key string, i int) *timerCounter {
 	return &timerCounter{
-		Timer(key),
-		CounterAt(key, i),
+		s.Timer(key),
+		s.CounterAt(key, i),
 	}
 }
 
@@ -109,8 +235,15 @@ func (t *timerCounter) IncrBy(i int) {
 	t.counter.IncrBy(i)
 }
 
+// Tag adds a tag to both the timer and the counter
+func (t *timerCounter) Tag(key, value string) *timerCounter {
+	t.timer.Tag(key, value)
+	t.counter.Tag(key, value)
+	return t
+}
+
 func (t *timerCounter) Emit() {
-	if !publishEnabled {
+	if !t.timer.s.running() {
 		return
 	}
 
@@ -119,51 +252,201 @@ func (t *timerCounter) Emit() {
 }
 
 type keyvalue struct {
-	key   string
+	metric
 	value string
 }
 
 func KeyValue(key string, value string) *keyvalue {
-	return &keyvalue{key, value}
+	return std.KeyValue(key, value)
+}
+
+func (s *Statsite) KeyValue(key string, value string) *keyvalue {
+	t := &keyvalue{metric: newMetric(s, key)}
+	var err error
+	t.value, err = DefaultSanitizer.SanitizeValue(value)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return t
+}
+
+// Tag adds a tag to the key/value
+func (t *keyvalue) Tag(key, value string) *keyvalue {
+	t.tag(key, value)
+	return t
 }
 
 func (t *keyvalue) Emit() {
-	if !publishEnabled {
+	if !t.s.running() {
 		return
 	}
 
-	kv := NewKeyValue(fmt.Sprintf("%s.%s", metricPrefix, t.key), t.value)
-	publishWG.Add(1)
-	go publish(kv)
+	m := t.message(TYPE_KEY_VALUE)
+	m.Value = t.value
+	t.s.publish(m)
 }
 
 type gauge struct {
-	key   string
+	metric
 	value int
+	// float is set when the gauge holds a floating-point value
+	float      bool
+	floatValue float64
+	// delta is set when the gauge adjusts the current value by its value
+	// rather than replacing it
+	delta bool
 }
 
 func Gauge(key string) *gauge {
-	return &gauge{key, 0}
+	return std.Gauge(key)
+}
+
+func (s *Statsite) Gauge(key string) *gauge {
+	return &gauge{newMetric(s, key), 0, false, 0, false}
 }
 
 func GaugeAt(key string, value int) *gauge {
-	return &gauge{key, value}
+	return std.GaugeAt(key, value)
+}
+
+func (s *Statsite) GaugeAt(key string, value int) *gauge {
+	return &gauge{newMetric(s, key), value, false, float64(value), false}
+}
+
+func GaugeFloat(key string, value float64) *gauge {
+	return std.GaugeFloat(key, value)
+}
+
+func (s *Statsite) GaugeFloat(key string, value float64) *gauge {
+	return &gauge{newMetric(s, key), 0, true, value, false}
+}
+
+// GaugeDelta is a gauge that adjusts the current value of the gauge by delta,
+// plus anything added with Incr and IncrBy, when emitted
+func GaugeDelta(key string, delta int) *gauge {
+	return std.GaugeDelta(key, delta)
+}
+
+func (s *Statsite) GaugeDelta(key string, delta int) *gauge {
+	return &gauge{newMetric(s, key), delta, false, float64(delta), true}
 }
 
 func (t *gauge) Incr() {
-	t.value += 1
+	t.IncrBy(1)
 }
 
 func (t *gauge) IncrBy(i int) {
 	t.value += i
+	t.floatValue += float64(i)
+}
+
+// Set replaces the value of the gauge with a floating-point value
+func (t *gauge) Set(value float64) {
+	t.float = true
+	t.floatValue = value
+}
+
+// EmitDelta adjusts the current value of the gauge by delta without changing
+// the value held by the gauge
+func (t *gauge) EmitDelta(delta int) {
+	if !t.s.running() {
+		return
+	}
+
+	m := t.message(TYPE_GAUGE)
+	m.kind = valueInt
+	m.intValue = int64(delta)
+	m.delta = true
+	t.s.publish(m)
+}
+
+// EmitDeltaFloat is EmitDelta with a floating-point delta
+func (t *gauge) EmitDeltaFloat(delta float64) {
+	if !t.s.running() {
+		return
+	}
+
+	m := t.message(TYPE_GAUGE)
+	m.kind = valueFloat
+	m.floatValue = delta
+	m.delta = true
+	t.s.publish(m)
+}
+
+// Tag adds a tag to the gauge
+func (t *gauge) Tag(key, value string) *gauge {
+	t.tag(key, value)
+	return t
 }
 
 func (t *gauge) Emit() {
-	if !publishEnabled {
+	if !t.s.running() {
 		return
 	}
 
-	guage := NewGauge(fmt.Sprintf("%s.%s", metricPrefix, t.key), t.value)
-	publishWG.Add(1)
-	go publish(guage)
+	m := t.message(TYPE_GAUGE)
+	if t.float {
+		m.kind = valueFloat
+		m.floatValue = t.floatValue
+	} else {
+		m.kind = valueInt
+		m.intValue = int64(t.value)
+	}
+	m.delta = t.delta
+	t.s.publish(m)
+}
+
+// Histogram Metric
+// h := Histogram(key)
+// h.Observe(value)
+// h.Emit()
+// Distribution(key) works the same way for DogStatsD compatible backends.
+type histogram struct {
+	metric
+	typ    MessageType
+	values []float64
+}
+
+func Histogram(key string) *histogram {
+	return std.Histogram(key)
+}
+
+func (s *Statsite) Histogram(key string) *histogram {
+	return &histogram{newMetric(s, key), TYPE_HISTOGRAM, nil}
+}
+
+func Distribution(key string) *histogram {
+	return std.Distribution(key)
+}
+
+func (s *Statsite) Distribution(key string) *histogram {
+	return &histogram{newMetric(s, key), TYPE_DISTRIBUTION, nil}
+}
+
+// Observe records a value to be sent by the next Emit
+func (t *histogram) Observe(value float64) {
+	t.values = append(t.values, value)
+}
+
+// Tag adds a tag to the histogram
+func (t *histogram) Tag(key, value string) *histogram {
+	t.tag(key, value)
+	return t
+}
+
+// Emit sends every value observed since the last Emit. The values are
+// cleared even when the Statsite is not running.
+func (t *histogram) Emit() {
+	if !t.s.running() {
+		t.values = t.values[:0]
+		return
+	}
+
+	for _, value := range t.values {
+		m := t.message(t.typ)
+		m.kind = valueFloat
+		m.floatValue = value
+		t.s.publish(m)
+	}
+	t.values = t.values[:0]
 }
@@ -0,0 +1,77 @@
+package statsite
+
+import (
+	"sync"
+	"testing"
+)
+
+func newBenchStatsite() *Statsite {
+	server := &mockStatsite{}
+	network := NewMockNetwork(map[string]mockServer{"statsite": server})
+	return New("bench", NewNetworkClient("statsite", network))
+}
+
+// BenchmarkEmit measures emitting a counter, which adds it to the queue
+// without blocking
+func BenchmarkEmit(b *testing.B) {
+	s := newBenchStatsite()
+	defer s.Shutdown()
+	c := s.CounterAt("counter", 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Emit()
+	}
+}
+
+func BenchmarkEmitParallel(b *testing.B) {
+	s := newBenchStatsite()
+	defer s.Shutdown()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := s.CounterAt("counter", 1)
+		for pb.Next() {
+			c.Emit()
+		}
+	})
+}
+
+// goroutinePublish is the old publish path, which started a goroutine for
+// every metric so that Emit never blocked on the queue
+func goroutinePublish(s *Statsite, wg *sync.WaitGroup, m message) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.publish(m)
+	}()
+}
+
+// BenchmarkEmitGoroutine measures the old design for comparison
+func BenchmarkEmitGoroutine(b *testing.B) {
+	s := newBenchStatsite()
+	defer s.Shutdown()
+	var wg sync.WaitGroup
+	m := *NewCounter("counter", 1).(*message)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		goroutinePublish(s, &wg, m)
+	}
+	wg.Wait()
+}
+
+func BenchmarkEmitGoroutineParallel(b *testing.B) {
+	s := newBenchStatsite()
+	defer s.Shutdown()
+	var wg sync.WaitGroup
+	m := *NewCounter("counter", 1).(*message)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			goroutinePublish(s, &wg, m)
+		}
+	})
+	wg.Wait()
+}
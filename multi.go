@@ -0,0 +1,220 @@
+package statsite
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// MultiQueueSize is how many Messages each backend of a MultiClient holds
+// while it is busy. Messages emitted while a backend's queue is full are
+// dropped for that backend only.
+var MultiQueueSize = 1024
+
+// MultiClient is a Client that sends every Message to several Clients, such
+// as two statsite clusters during a migration. Each backend is written to by
+// its own goroutine and reconnects with its own backoff, so a backend that is
+// down or slow drops its own Messages without delaying the others. Emit
+// never blocks and only fails once every backend has dropped the Message.
+// A Statsite sends its batches to every backend in the statsite line
+// protocol, so every backend must use the StatsiteEncoder.
+type MultiClient struct {
+	lock     sync.Mutex
+	backends []*backend
+	running  bool
+	wg       sync.WaitGroup
+}
+
+// BackendStatus is what has happened to the Messages sent to one backend of
+// a MultiClient
+type BackendStatus struct {
+	Connected bool
+	// Sent is the number of Messages written to the backend
+	Sent uint64
+	// Dropped is the number of Messages the backend could not take or write
+	Dropped uint64
+	// Err is the last error from the backend, nil if there has been none
+	Err error
+}
+
+type backend struct {
+	// sent and dropped are first to stay aligned for atomic access
+	sent    uint64
+	dropped uint64
+	client  Client
+	redial  redial
+	queue   chan Message
+
+	errLock sync.Mutex
+	err     error
+}
+
+// rawMessage holds the encoded lines of a batch, which the flusher reuses
+// once it has been emitted
+type rawMessage []byte
+
+func (m rawMessage) String() string {
+	return string(m)
+}
+
+func (m rawMessage) AppendTo(buf []byte) []byte {
+	return append(buf, m...)
+}
+
+// NewMultiClient returns a MultiClient sending to every one of clients. It
+// returns an error if any of clients encodes with an Encoder other than the
+// StatsiteEncoder, since the batches it is given are already encoded.
+func NewMultiClient(clients ...Client) (*MultiClient, error) {
+	m := &MultiClient{}
+	for i, client := range clients {
+		if _, ok := encoderOf(client).(StatsiteEncoder); !ok {
+			return nil, fmt.Errorf("statsite backend %d does not use the StatsiteEncoder", i)
+		}
+		m.backends = append(m.backends, &backend{
+			client: client,
+			redial: redial{backoff: defaultBackoff()},
+		})
+	}
+	return m, nil
+}
+
+// start begins delivering to each backend. It must be called with the lock
+// held.
+func (m *MultiClient) start() {
+	if m.running {
+		return
+	}
+	m.running = true
+	for _, b := range m.backends {
+		b.queue = make(chan Message, MultiQueueSize)
+		m.wg.Add(1)
+		go func(b *backend) {
+			defer m.wg.Done()
+			b.run()
+		}(b)
+	}
+}
+
+// Connect starts delivering to the backends, which connect on their own. It
+// never fails.
+func (m *MultiClient) Connect() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.start()
+	return nil
+}
+
+// Emit queues msg for every backend
+func (m *MultiClient) Emit(msg Message) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.start()
+	if b, ok := msg.(*batch); ok {
+		msg = rawMessage(append([]byte(nil), b.buf...))
+	}
+	queued := false
+	for _, b := range m.backends {
+		select {
+		case b.queue <- msg:
+			queued = true
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+	if !queued && len(m.backends) > 0 {
+		return errMultiFull
+	}
+	return nil
+}
+
+// errMultiFull is returned by Emit when no backend could take a Message
+var errMultiFull = errors.New("every statsite backend is full")
+
+// Close delivers what the backends hold, as far as they can, and closes them,
+// returning the first error from closing a backend
+func (m *MultiClient) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.running {
+		return nil
+	}
+	m.running = false
+	for _, b := range m.backends {
+		close(b.queue)
+	}
+	m.wg.Wait()
+	var err error
+	for _, b := range m.backends {
+		if closeErr := b.client.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Connected reports whether any backend holds a connection
+func (m *MultiClient) Connected() bool {
+	for _, b := range m.backends {
+		if b.client.Connected() {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the status of each backend in the order they were given to
+// NewMultiClient
+func (m *MultiClient) Status() []BackendStatus {
+	status := make([]BackendStatus, len(m.backends))
+	for i, b := range m.backends {
+		b.errLock.Lock()
+		status[i] = BackendStatus{
+			Connected: b.client.Connected(),
+			Sent:      atomic.LoadUint64(&b.sent),
+			Dropped:   atomic.LoadUint64(&b.dropped),
+			Err:       b.err,
+		}
+		b.errLock.Unlock()
+	}
+	return status
+}
+
+// run writes each queued Message until the queue is closed
+func (b *backend) run() {
+	for msg := range b.queue {
+		if err := b.deliver(msg); err != nil {
+			atomic.AddUint64(&b.dropped, 1)
+			b.errLock.Lock()
+			b.err = err
+			b.errLock.Unlock()
+		} else {
+			atomic.AddUint64(&b.sent, 1)
+		}
+	}
+}
+
+func (b *backend) deliver(msg Message) error {
+	if !b.client.Connected() {
+		if err := b.redial.allow(); err != nil {
+			return fmt.Errorf("Error connecting to statsite: %v", err)
+		}
+		if err := b.client.Connect(); err != nil {
+			b.redial.failed()
+			return err
+		}
+		b.redial.succeeded()
+	}
+	err := b.client.Emit(msg)
+	if err == nil {
+		if f, ok := b.client.(Flusher); ok {
+			err = f.Flush()
+		}
+	}
+	if err != nil {
+		// Reconnect before the next Message, after the backoff
+		b.client.Close()
+		b.redial.failed()
+	}
+	return err
+}
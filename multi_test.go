@@ -0,0 +1,148 @@
+package statsite
+
+import (
+	"sort"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MultiSuite struct {
+	mockNetwork Network
+	primary     *mockStatsite
+	secondary   *mockStatsite
+}
+
+var _ = Suite(&MultiSuite{})
+
+func (s *MultiSuite) SetUpTest(c *C) {
+	s.primary = &mockStatsite{}
+	s.secondary = &mockStatsite{}
+	serverMap := make(map[string]mockServer)
+	serverMap["primary"] = mockServer(s.primary)
+	serverMap["secondary"] = mockServer(s.secondary)
+	s.mockNetwork = NewMockNetwork(serverMap)
+}
+
+// blockingClient is a Client whose Emit blocks until it is released
+type blockingClient struct {
+	release chan struct{}
+}
+
+func (t *blockingClient) Connect() error  { return nil }
+func (t *blockingClient) Close() error    { return nil }
+func (t *blockingClient) Connected() bool { return true }
+
+func (t *blockingClient) Emit(msg Message) error {
+	<-t.release
+	return nil
+}
+
+// newMultiClient is NewMultiClient for clients that are known to be valid
+func newMultiClient(c *C, clients ...Client) *MultiClient {
+	m, err := NewMultiClient(clients...)
+	c.Assert(err, IsNil)
+	return m
+}
+
+func (s *MultiSuite) TestFanOut(c *C) {
+	m := newMultiClient(c,
+		NewNetworkClient("primary", s.mockNetwork),
+		NewNetworkClient("secondary", s.mockNetwork),
+	)
+	st := New("foo", m)
+	st.CounterAt("hits", 1).Emit()
+	st.KeyValue("key", "value").Emit()
+	st.Shutdown()
+
+	want := []string{"foo.hits:1|c\n", "foo.key:value|kv\n"}
+	for _, server := range []*mockStatsite{s.primary, s.secondary} {
+		lines := server.Read()
+		sort.Strings(lines)
+		c.Assert(lines, DeepEquals, want)
+	}
+	for _, status := range m.Status() {
+		c.Assert(status.Dropped, Equals, uint64(0))
+		c.Assert(status.Err, IsNil)
+	}
+	c.Assert(m.Connected(), Equals, false)
+}
+
+func (s *MultiSuite) TestDeadBackend(c *C) {
+	m := newMultiClient(c,
+		NewNetworkClient("badconnection", s.mockNetwork),
+		NewNetworkClient("secondary", s.mockNetwork),
+	)
+	c.Assert(m.Connect(), IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(m.Emit(NewCounter("hits", 1)), IsNil)
+	}
+	c.Assert(m.Close(), IsNil)
+
+	c.Assert(s.secondary.Count(), Equals, 3)
+	status := m.Status()
+	c.Assert(status[0].Sent, Equals, uint64(0))
+	c.Assert(status[0].Dropped, Equals, uint64(3))
+	c.Assert(status[0].Err, ErrorMatches, "Error connecting to statsite: .*")
+	c.Assert(status[1].Sent, Equals, uint64(3))
+	c.Assert(status[1].Err, IsNil)
+}
+
+func (s *MultiSuite) TestSlowBackend(c *C) {
+	defer func(size int) { MultiQueueSize = size }(MultiQueueSize)
+	MultiQueueSize = 1
+	slow := &blockingClient{release: make(chan struct{})}
+	m := newMultiClient(c, slow, NewNetworkClient("secondary", s.mockNetwork))
+	for i := 1; i <= 10; i++ {
+		c.Assert(m.Emit(NewCounter("hits", 1)), IsNil)
+		// The stuck backend does not hold up the other one
+		deadline := time.Now().Add(5 * time.Second)
+		for s.secondary.Count() < i && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(s.secondary.Count(), Equals, i)
+	}
+	// The stuck backend holds one Message and queues one more
+	c.Assert(m.Status()[0].Dropped, Equals, uint64(8))
+	close(slow.release)
+	c.Assert(m.Close(), IsNil)
+}
+
+func (s *MultiSuite) TestAllBackendsFull(c *C) {
+	defer func(size int) { MultiQueueSize = size }(MultiQueueSize)
+	MultiQueueSize = 1
+	slow := &blockingClient{release: make(chan struct{})}
+	m := newMultiClient(c, slow)
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = m.Emit(NewCounter("hits", 1))
+	}
+	c.Assert(err, ErrorMatches, "every statsite backend is full")
+	close(slow.release)
+	c.Assert(m.Close(), IsNil)
+}
+
+func (s *MultiSuite) TestBatchIsCopied(c *C) {
+	m := newMultiClient(c, NewNetworkClient("primary", s.mockNetwork))
+	b := &batch{buf: []byte("foo:1|c\n"), count: 1}
+	c.Assert(m.Emit(b), IsNil)
+	// The flusher reuses the batch once it has been emitted
+	copy(b.buf, "bar")
+	c.Assert(m.Close(), IsNil)
+	c.Assert(s.primary.Read(), DeepEquals, []string{"foo:1|c\n"})
+}
+
+func (s *MultiSuite) TestOtherEncoder(c *C) {
+	graphite := NewClientWithOptions("secondary", ClientOptions{
+		Network: s.mockNetwork,
+		Encoder: GraphiteEncoder{},
+	})
+	_, err := NewMultiClient(NewNetworkClient("primary", s.mockNetwork), graphite)
+	c.Assert(err, ErrorMatches, "statsite backend 1 does not use the StatsiteEncoder")
+	statsite := NewClientWithOptions("secondary", ClientOptions{
+		Network: s.mockNetwork,
+		Encoder: StatsiteEncoder{},
+	})
+	_, err = NewMultiClient(statsite)
+	c.Assert(err, IsNil)
+}
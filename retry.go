@@ -0,0 +1,70 @@
+package statsite
+
+// DropPolicy decides which messages a full retry buffer discards
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest buffered message to make room
+	DropOldest DropPolicy = iota
+	// DropNewest discards the message that did not fit
+	DropNewest
+)
+
+// retryBuffer holds the messages received while statsite is unreachable so
+// that they can be replayed once the client reconnects
+type retryBuffer struct {
+	maxMessages int
+	maxBytes    int
+	policy      DropPolicy
+	lines       []string
+	bytes       int
+}
+
+func newRetryBuffer(maxMessages, maxBytes int, policy DropPolicy) *retryBuffer {
+	return &retryBuffer{
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+		policy:      policy,
+	}
+}
+
+func (r *retryBuffer) full(size int) bool {
+	if r.maxMessages > 0 && len(r.lines)+1 > r.maxMessages {
+		return true
+	}
+	return r.maxBytes > 0 && r.bytes+size > r.maxBytes
+}
+
+// add buffers a line, returning the number of lines dropped to respect the
+// buffer's limits
+func (r *retryBuffer) add(line string) int {
+	dropped := 0
+	if r.policy == DropNewest || (r.maxBytes > 0 && len(line) > r.maxBytes) {
+		if r.full(len(line)) {
+			return 1
+		}
+	} else {
+		for len(r.lines) > 0 && r.full(len(line)) {
+			r.bytes -= len(r.lines[0])
+			r.lines[0] = ""
+			r.lines = r.lines[1:]
+			dropped++
+		}
+	}
+	r.lines = append(r.lines, line)
+	r.bytes += len(line)
+	return dropped
+}
+
+func (r *retryBuffer) len() int {
+	return len(r.lines)
+}
+
+// pop removes and returns the oldest buffered line
+func (r *retryBuffer) pop() string {
+	line := r.lines[0]
+	r.lines[0] = ""
+	r.lines = r.lines[1:]
+	r.bytes -= len(line)
+	return line
+}
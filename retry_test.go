@@ -0,0 +1,95 @@
+package statsite
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) TestDropOldestByCount(c *C) {
+	r := newRetryBuffer(2, 0, DropOldest)
+	c.Assert(r.add("a\n"), Equals, 0)
+	c.Assert(r.add("b\n"), Equals, 0)
+	c.Assert(r.add("c\n"), Equals, 1)
+	c.Assert(r.len(), Equals, 2)
+	c.Assert(r.pop(), Equals, "b\n")
+	c.Assert(r.pop(), Equals, "c\n")
+	c.Assert(r.bytes, Equals, 0)
+}
+
+func (s *RetrySuite) TestDropNewestByCount(c *C) {
+	r := newRetryBuffer(2, 0, DropNewest)
+	c.Assert(r.add("a\n"), Equals, 0)
+	c.Assert(r.add("b\n"), Equals, 0)
+	c.Assert(r.add("c\n"), Equals, 1)
+	c.Assert(r.len(), Equals, 2)
+	c.Assert(r.pop(), Equals, "a\n")
+	c.Assert(r.pop(), Equals, "b\n")
+}
+
+func (s *RetrySuite) TestDropOldestByBytes(c *C) {
+	r := newRetryBuffer(0, 5, DropOldest)
+	r.add("a\n")
+	r.add("b\n")
+	c.Assert(r.add("cc\n"), Equals, 1)
+	c.Assert(r.len(), Equals, 2)
+	c.Assert(r.bytes, Equals, 5)
+	// A line larger than the whole buffer is dropped without evicting
+	c.Assert(r.add("dddddd\n"), Equals, 1)
+	c.Assert(r.pop(), Equals, "b\n")
+}
+
+func (s *RetrySuite) TestDropNewestByBytes(c *C) {
+	r := newRetryBuffer(0, 5, DropNewest)
+	r.add("a\n")
+	r.add("b\n")
+	c.Assert(r.add("cc\n"), Equals, 1)
+	c.Assert(r.len(), Equals, 2)
+	c.Assert(r.bytes, Equals, 4)
+}
+
+// flakyStatsite is a mockStatsite that fails every write while it is down
+type flakyStatsite struct {
+	*mockStatsite
+	down     int32
+	failures int32
+}
+
+func (t *flakyStatsite) Write(s string) error {
+	if atomic.LoadInt32(&t.down) == 1 {
+		atomic.AddInt32(&t.failures, 1)
+		return errFlaky
+	}
+	return t.mockStatsite.Write(s)
+}
+
+var errFlaky = errors.New("statsite is down")
+
+func (s *RetrySuite) TestReplay(c *C) {
+	flaky := &flakyStatsite{mockStatsite: &mockStatsite{}, down: 1}
+	network := NewMockNetwork(map[string]mockServer{"statsite": flaky})
+	st := New("foo", NewNetworkClient("statsite", network),
+		WithBatchSize(0),
+		WithBackoff(ConstantBackoff(50*time.Millisecond)),
+		WithRetryBuffer(10, 0, DropOldest),
+	)
+	st.KeyValue("failed", "a").Emit()
+	for atomic.LoadInt32(&flaky.failures) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The flusher is now waiting to reconnect and holds these
+	st.KeyValue("held", "b").Emit()
+	st.KeyValue("held", "c").Emit()
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt32(&flaky.down, 0)
+	st.Shutdown()
+	// The line whose write failed is replayed first
+	c.Assert(flaky.Read(), DeepEquals, []string{"foo.failed:a|kv\n", "foo.held:b|kv\n", "foo.held:c|kv\n"})
+	c.Assert(st.Stats().DroppedDisconnected, Equals, uint64(0))
+}
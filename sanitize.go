@@ -0,0 +1,131 @@
+package statsite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Sanitizer checks the keys and values of messages as they are constructed
+// for characters that would corrupt the line protocol, such as a ':' or '|'
+// in a key or a newline that would start another message. It returns the
+// cleaned up key or value, or an error if it should not be sent.
+type Sanitizer interface {
+	SanitizeKey(key string) (string, error)
+	SanitizeValue(value string) (string, error)
+}
+
+// DefaultSanitizer is the Sanitizer used by every message constructor. It
+// replaces invalid characters with an underscore.
+var DefaultSanitizer Sanitizer = ReplaceSanitizer{Replacement: "_"}
+
+// InvalidError reports a key or value that a Sanitizer rejected
+type InvalidError struct {
+	// Field is either "key" or "value"
+	Field string
+	Text  string
+	// Char is the first invalid character in Text
+	Char rune
+}
+
+func (e *InvalidError) Error() string {
+	return fmt.Sprintf("invalid statsite %s %q: contains %q", e.Field, e.Text, e.Char)
+}
+
+// invalidKeyRune reports whether r cannot appear in a key. Keys end at the
+// first ':' and may not contain whitespace.
+func invalidKeyRune(r rune) bool {
+	switch r {
+	case ':', '|', '\n', '\r', ' ', '\t':
+		return true
+	}
+	return false
+}
+
+// invalidValueRune reports whether r cannot appear in a value. Values end at
+// the first '|'.
+func invalidValueRune(r rune) bool {
+	switch r {
+	case '|', '\n', '\r':
+		return true
+	}
+	return false
+}
+
+// ReplaceSanitizer replaces every invalid character with Replacement
+type ReplaceSanitizer struct {
+	Replacement string
+}
+
+// SanitizeKey replaces the invalid characters in key
+func (t ReplaceSanitizer) SanitizeKey(key string) (string, error) {
+	return replaceInvalid(key, invalidKeyRune, t.Replacement), nil
+}
+
+// SanitizeValue replaces the invalid characters in value
+func (t ReplaceSanitizer) SanitizeValue(value string) (string, error) {
+	return replaceInvalid(value, invalidValueRune, t.Replacement), nil
+}
+
+// StripSanitizer removes every invalid character
+type StripSanitizer struct{}
+
+// SanitizeKey removes the invalid characters from key
+func (t StripSanitizer) SanitizeKey(key string) (string, error) {
+	return replaceInvalid(key, invalidKeyRune, ""), nil
+}
+
+// SanitizeValue removes the invalid characters from value
+func (t StripSanitizer) SanitizeValue(value string) (string, error) {
+	return replaceInvalid(value, invalidValueRune, ""), nil
+}
+
+// RejectSanitizer returns an *InvalidError for any key or value holding an
+// invalid character
+type RejectSanitizer struct{}
+
+// SanitizeKey returns an error if key holds an invalid character
+func (t RejectSanitizer) SanitizeKey(key string) (string, error) {
+	if i := strings.IndexFunc(key, invalidKeyRune); i >= 0 {
+		return key, &InvalidError{Field: "key", Text: key, Char: rune(key[i])}
+	}
+	return key, nil
+}
+
+// SanitizeValue returns an error if value holds an invalid character
+func (t RejectSanitizer) SanitizeValue(value string) (string, error) {
+	if i := strings.IndexFunc(value, invalidValueRune); i >= 0 {
+		return value, &InvalidError{Field: "value", Text: value, Char: rune(value[i])}
+	}
+	return value, nil
+}
+
+// NoopSanitizer passes keys and values through untouched
+type NoopSanitizer struct{}
+
+// SanitizeKey returns key unchanged
+func (t NoopSanitizer) SanitizeKey(key string) (string, error) {
+	return key, nil
+}
+
+// SanitizeValue returns value unchanged
+func (t NoopSanitizer) SanitizeValue(value string) (string, error) {
+	return value, nil
+}
+
+// replaceInvalid replaces every rune in s for which invalid is true,
+// returning s itself when there is nothing to replace
+func replaceInvalid(s string, invalid func(rune) bool, replacement string) string {
+	if strings.IndexFunc(s, invalid) < 0 {
+		return s
+	}
+	var b bytes.Buffer
+	for _, r := range s {
+		if invalid(r) {
+			b.WriteString(replacement)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package statsite
+
+import (
+	"testing"
+)
+
+func TestReplaceSanitizer(t *testing.T) {
+	m := NewKeyValue("a b:c|d\ne", "x|y\nz:w")
+
+	Assert(t, "a_b_c_d_e:x_y_z:w|kv\n", m.String())
+}
+
+func TestStripSanitizer(t *testing.T) {
+	defer func(s Sanitizer) { DefaultSanitizer = s }(DefaultSanitizer)
+	DefaultSanitizer = StripSanitizer{}
+
+	Assert(t, "abcde:3|c\n", NewCounter("a b:c|d\ne", 3).String())
+}
+
+func TestRejectSanitizer(t *testing.T) {
+	defer func(s Sanitizer) { DefaultSanitizer = s }(DefaultSanitizer)
+	DefaultSanitizer = RejectSanitizer{}
+
+	m, err := Checked(NewCounter("foo:bar", 1))
+	Assert(t, `invalid statsite key "foo:bar": contains ':'`, err.Error())
+	Assert(t, "", m.String())
+
+	_, err = Checked(NewSet("foo", "a|b"))
+	Assert(t, `invalid statsite value "a|b": contains '|'`, err.Error())
+
+	_, err = Checked(Tagged(NewCounter("foo", 1), TagsDogStatsD, Tag{"a", "b c"}))
+	Assert(t, `invalid statsite key "b c": contains ' '`, err.Error())
+
+	m, err = Checked(NewCounter("foo.bar", 1))
+	Assert(t, nil, err)
+	Assert(t, "foo.bar:1|c\n", m.String())
+}
+
+func TestTaggedSanitized(t *testing.T) {
+	m := Tagged(NewCounter("foo", 1), TagsInKey, Tag{"a:b", "c|d"})
+
+	Assert(t, "foo.a_b.c_d:1|c\n", m.String())
+}
+
+func TestTagInjectionEscaped(t *testing.T) {
+	defer func(s Sanitizer) { DefaultSanitizer = s }(DefaultSanitizer)
+	DefaultSanitizer = NoopSanitizer{}
+	tag := Tag{"a=b#", "c,d=e:f"}
+	Assert(t, "foo,a\\=b#=c\\,d\\=e:f:1|c\n", Tagged(NewCounter("foo", 1), TagsInflux, tag).String())
+	Assert(t, "foo:1|c|#a=b_:c_d=e_f\n", Tagged(NewCounter("foo", 1), TagsDogStatsD, tag).String())
+}
@@ -0,0 +1,100 @@
+package statsite
+
+import (
+	"sync/atomic"
+)
+
+// Stats counts what has happened to the metrics passed to a Statsite
+type Stats struct {
+	// Enqueued is the number of messages added to the queue or aggregated
+	Enqueued uint64
+	// DroppedQueueFull is the number of messages dropped because the queue
+	// was full
+	DroppedQueueFull uint64
+	// DroppedInvalid is the number of messages dropped because the
+	// DefaultSanitizer rejected them
+	DroppedInvalid uint64
+	// DroppedDisconnected is the number of messages dropped because statsite
+	// could not be reached or a write to it failed
+	DroppedDisconnected uint64
+	// WriteErrors is the number of writes to statsite that failed
+	WriteErrors uint64
+	// Reconnects is the number of times the flusher reconnected to statsite
+	// after losing its connection
+	Reconnects uint64
+	// BytesSent is the number of bytes successfully written to statsite
+	BytesSent uint64
+}
+
+// statsCounters holds the running Stats of a Statsite
+type statsCounters struct {
+	enqueued            uint64
+	droppedQueueFull    uint64
+	droppedInvalid      uint64
+	droppedDisconnected uint64
+	writeErrors         uint64
+	reconnects          uint64
+	bytesSent           uint64
+}
+
+func (c *statsCounters) snapshot() Stats {
+	return Stats{
+		Enqueued:            atomic.LoadUint64(&c.enqueued),
+		DroppedQueueFull:    atomic.LoadUint64(&c.droppedQueueFull),
+		DroppedInvalid:      atomic.LoadUint64(&c.droppedInvalid),
+		DroppedDisconnected: atomic.LoadUint64(&c.droppedDisconnected),
+		WriteErrors:         atomic.LoadUint64(&c.writeErrors),
+		Reconnects:          atomic.LoadUint64(&c.reconnects),
+		BytesSent:           atomic.LoadUint64(&c.bytesSent),
+	}
+}
+
+// GetStats returns the Stats of the package level Statsite
+func GetStats() Stats {
+	return std.Stats()
+}
+
+// Stats returns what has happened to the metrics passed to the Statsite
+func (s *Statsite) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// appendStats adds a counter line to the batch for every Stats field that
+// has changed since last was taken. Nothing is added while the
+// DefaultSanitizer rejects the prefix.
+func (s *Statsite) appendStats(b *batch, encoder Encoder, last Stats) Stats {
+	now := s.Stats()
+	s.l.RLock()
+	prefix, prefixErr := s.prefix, s.prefixErr
+	s.l.RUnlock()
+	if prefixErr != nil {
+		return now
+	}
+	deltas := []struct {
+		name  string
+		delta uint64
+	}{
+		{"enqueued", now.Enqueued - last.Enqueued},
+		{"dropped_queue_full", now.DroppedQueueFull - last.DroppedQueueFull},
+		{"dropped_invalid", now.DroppedInvalid - last.DroppedInvalid},
+		{"dropped_disconnected", now.DroppedDisconnected - last.DroppedDisconnected},
+		{"write_errors", now.WriteErrors - last.WriteErrors},
+		{"reconnects", now.Reconnects - last.Reconnects},
+		{"bytes_sent", now.BytesSent - last.BytesSent},
+	}
+	for _, d := range deltas {
+		if d.delta == 0 {
+			continue
+		}
+		msg := message{
+			Prefix:   prefix,
+			Key:      "statsite_client." + d.name,
+			Type:     TYPE_COUNTER,
+			kind:     valueInt,
+			intValue: int64(d.delta),
+		}
+		b.buf = appendMessage(encoder, b.buf, msg)
+		b.count++
+	}
+	return now
+}
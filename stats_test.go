@@ -0,0 +1,113 @@
+package statsite
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type StatsSuite struct {
+	mockNetwork  Network
+	mockStatsite *mockStatsite
+}
+
+var _ = Suite(&StatsSuite{})
+
+func (s *StatsSuite) SetUpTest(c *C) {
+	s.mockStatsite = &mockStatsite{}
+	serverMap := make(map[string]mockServer)
+	serverMap["statsite"] = mockServer(s.mockStatsite)
+	s.mockNetwork = NewMockNetwork(serverMap)
+}
+
+func (s *StatsSuite) TestDelivered(c *C) {
+	st := New("foo", NewNetworkClient("statsite", s.mockNetwork))
+	st.KeyValue("a", "1").Emit()
+	st.KeyValue("b", "2").Emit()
+	st.Shutdown()
+	stats := st.Stats()
+	c.Assert(stats.Enqueued, Equals, uint64(2))
+	c.Assert(stats.BytesSent, Equals, uint64(2*len("foo.a:1|kv\n")))
+	c.Assert(stats.DroppedQueueFull, Equals, uint64(0))
+	c.Assert(stats.DroppedDisconnected, Equals, uint64(0))
+	c.Assert(stats.WriteErrors, Equals, uint64(0))
+}
+
+func (s *StatsSuite) TestAggregated(c *C) {
+	st := New("foo", NewNetworkClient("statsite", s.mockNetwork), WithAggregation(time.Hour))
+	for i := 0; i < 5; i++ {
+		st.CounterAt("hits", 1).Emit()
+	}
+	st.Shutdown()
+	stats := st.Stats()
+	c.Assert(stats.Enqueued, Equals, uint64(5))
+	c.Assert(stats.BytesSent, Equals, uint64(len("foo.hits:5|c\n")))
+	c.Assert(stats.DroppedDisconnected, Equals, uint64(0))
+}
+
+func (s *StatsSuite) TestDroppedDisconnected(c *C) {
+	st := New("foo", NewNetworkClient("badconnection", s.mockNetwork),
+		WithBackoff(ConstantBackoff(10*time.Millisecond)),
+	)
+	st.KeyValue("a", "1").Emit()
+	st.KeyValue("b", "2").Emit()
+	st.Shutdown()
+	stats := st.Stats()
+	c.Assert(stats.Enqueued, Equals, uint64(2))
+	c.Assert(stats.DroppedDisconnected, Equals, uint64(2))
+	c.Assert(stats.BytesSent, Equals, uint64(0))
+}
+
+func (s *StatsSuite) TestWriteErrors(c *C) {
+	// No prefix so that the message reaches the mockStatsite as it is
+	st := New("", NewNetworkClient("statsite", s.mockNetwork),
+		WithBatchSize(0),
+		WithBackoff(ConstantBackoff(time.Millisecond)),
+	)
+	// The mockStatsite refuses this message
+	st.KeyValue("bad", "key").Emit()
+	for st.Stats().WriteErrors == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for st.Stats().Reconnects == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	st.KeyValue("a", "1").Emit()
+	st.Shutdown()
+	stats := st.Stats()
+	c.Assert(stats.WriteErrors, Equals, uint64(1))
+	c.Assert(stats.DroppedDisconnected, Equals, uint64(1))
+	c.Assert(stats.Reconnects, Equals, uint64(1))
+	c.Assert(s.mockStatsite.Count(), Equals, 1)
+}
+
+func (s *StatsSuite) TestEmitStats(c *C) {
+	st := New("foo", NewNetworkClient("statsite", s.mockNetwork),
+		WithStatsInterval(10*time.Millisecond),
+	)
+	st.KeyValue("a", "1").Emit()
+	deadline := time.Now().Add(time.Second)
+	found := false
+	for !found && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		s.mockStatsite.lock.Lock()
+		for _, line := range s.mockStatsite.receivedMessages {
+			found = found || line == "foo.statsite_client.enqueued:1|c\n"
+		}
+		s.mockStatsite.lock.Unlock()
+	}
+	st.Shutdown()
+	c.Assert(found, Equals, true)
+}
+
+func (s *StatsSuite) TestDroppedInvalid(c *C) {
+	defer func(sanitizer Sanitizer) { DefaultSanitizer = sanitizer }(DefaultSanitizer)
+	DefaultSanitizer = RejectSanitizer{}
+
+	st := New("foo", NewNetworkClient("statsite", s.mockNetwork))
+	st.KeyValue("bad key", "1").Emit()
+	st.KeyValue("good", "1").Emit()
+	st.Shutdown()
+	c.Assert(st.Stats().DroppedInvalid, Equals, uint64(1))
+	c.Assert(s.mockStatsite.Read(), DeepEquals, []string{"foo.good:1|kv\n"})
+}
@@ -0,0 +1,254 @@
+package statsitetest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiip/go-statsite"
+)
+
+// Flushed is what a Server aggregated over one flush interval, the way
+// statsite aggregates it before passing it on to a sink
+type Flushed struct {
+	// Counters are the sums of the counts for each key, with sampled
+	// counts scaled back up
+	Counters map[string]float64
+	// Timers are the timings for each key in the order they arrived
+	Timers map[string][]float64
+	// Sets are the number of unique members of each set
+	Sets map[string]int
+	// Gauges are the last value of each gauge with any later deltas added
+	Gauges map[string]float64
+	// KeyValues are the values sent for each key in the order they arrived
+	KeyValues map[string][]string
+}
+
+func newFlushed() *Flushed {
+	return &Flushed{
+		Counters:  make(map[string]float64),
+		Timers:    make(map[string][]float64),
+		Sets:      make(map[string]int),
+		Gauges:    make(map[string]float64),
+		KeyValues: make(map[string][]string),
+	}
+}
+
+// Server is a fake statsite server that listens on TCP and UDP loopback and
+// aggregates the lines it receives. Lines that do not parse are kept by
+// Errors.
+type Server struct {
+	tcp net.Listener
+	udp net.PacketConn
+
+	lock     sync.Mutex
+	received int
+	flushed  *Flushed
+	sets     map[string]map[string]bool
+	errors   []error
+	conns    map[net.Conn]bool
+	closed   bool
+	// changed is closed and replaced whenever lines are received
+	changed chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a Server on loopback ports chosen by the system
+func NewServer() (*Server, error) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	s := &Server{
+		tcp:     tcp,
+		udp:     udp,
+		flushed: newFlushed(),
+		sets:    make(map[string]map[string]bool),
+		conns:   make(map[net.Conn]bool),
+		changed: make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.acceptTCP()
+	go s.readUDP()
+	return s, nil
+}
+
+// TCPAddr returns the "host:port" address the Server accepts TCP
+// connections on
+func (s *Server) TCPAddr() string {
+	return s.tcp.Addr().String()
+}
+
+// UDPAddr returns the "host:port" address the Server reads datagrams on
+func (s *Server) UDPAddr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// Close stops the Server, closing any open connections
+func (s *Server) Close() error {
+	err := s.tcp.Close()
+	if udpErr := s.udp.Close(); err == nil {
+		err = udpErr
+	}
+	s.lock.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.readTCP(conn)
+	}
+}
+
+func (s *Server) readTCP(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.receive(scanner.Text())
+	}
+}
+
+func (s *Server) readUDP() {
+	defer s.wg.Done()
+	packet := make([]byte, statsite.MaxPacketSize)
+	for {
+		n, _, err := s.udp.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+		for _, line := range bytes.Split(packet[:n], []byte("\n")) {
+			if len(line) > 0 {
+				s.receive(string(line))
+			}
+		}
+	}
+}
+
+// receive parses a line and adds it to the current flush interval
+func (s *Server) receive(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m, err := Parse(line)
+	if err == nil {
+		err = s.aggregate(m)
+	}
+	if err != nil {
+		s.errors = append(s.errors, err)
+	} else {
+		s.received++
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) aggregate(m Metric) error {
+	f := s.flushed
+	switch m.Type {
+	case statsite.TYPE_KEY_VALUE:
+		f.KeyValues[m.Key] = append(f.KeyValues[m.Key], m.Value)
+		return nil
+	case statsite.TYPE_SET:
+		members := s.sets[m.Key]
+		if members == nil {
+			members = make(map[string]bool)
+			s.sets[m.Key] = members
+		}
+		members[m.Value] = true
+		f.Sets[m.Key] = len(members)
+		return nil
+	}
+	value, err := m.Float()
+	if err != nil {
+		return fmt.Errorf("statsitetest: bad value in %q", m.Key+":"+m.Value)
+	}
+	switch m.Type {
+	case statsite.TYPE_COUNTER:
+		f.Counters[m.Key] += value / m.Rate
+	case statsite.TYPE_TIMER, statsite.TYPE_HISTOGRAM, statsite.TYPE_DISTRIBUTION:
+		f.Timers[m.Key] = append(f.Timers[m.Key], value)
+	case statsite.TYPE_GAUGE:
+		if strings.HasPrefix(m.Value, "+") || strings.HasPrefix(m.Value, "-") {
+			f.Gauges[m.Key] += value
+		} else {
+			f.Gauges[m.Key] = value
+		}
+	default:
+		return fmt.Errorf("statsitetest: unknown type %q", m.Type)
+	}
+	return nil
+}
+
+// Flush returns what was aggregated since the last Flush and starts a new
+// flush interval
+func (s *Server) Flush() *Flushed {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f := s.flushed
+	s.flushed = newFlushed()
+	s.sets = make(map[string]map[string]bool)
+	s.received = 0
+	return f
+}
+
+// Errors returns why any line that was received but not aggregated was
+// rejected
+func (s *Server) Errors() []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]error(nil), s.errors...)
+}
+
+// Wait blocks until at least n lines have been aggregated since the last
+// Flush, returning an error if they have not arrived within timeout
+func (s *Server) Wait(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		s.lock.Lock()
+		count, changed := s.received, s.changed
+		s.lock.Unlock()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("statsitetest: %d of %d lines arrived within %v", count, n, timeout)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package statsitetest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiip/go-statsite"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func emitAll(s *statsite.Statsite) {
+	s.CounterAt("hits", 2).Emit()
+	s.Timer("time").Emit()
+	s.GaugeAt("load", 5).Emit()
+	s.GaugeDelta("load", -2).Emit()
+	s.KeyValue("key", "value").Emit()
+	s.Shutdown()
+}
+
+func checkFlushed(t *testing.T, server *Server, lines int) {
+	if err := server.Wait(lines, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if errs := server.Errors(); len(errs) > 0 {
+		t.Fatalf("Server rejected lines: %v", errs)
+	}
+	f := server.Flush()
+	if f.Counters["app.hits"] != 2 {
+		t.Errorf("Counter summed to %v", f.Counters["app.hits"])
+	}
+	if len(f.Timers["app.time"]) != 1 {
+		t.Errorf("Timer was observed %d times", len(f.Timers["app.time"]))
+	}
+	if f.Gauges["app.load"] != 3 {
+		t.Errorf("Gauge is %v", f.Gauges["app.load"])
+	}
+	if !reflect.DeepEqual(f.KeyValues["app.key"], []string{"value"}) {
+		t.Errorf("Key/value is %v", f.KeyValues["app.key"])
+	}
+	// Flushing starts a new interval
+	if f := server.Flush(); len(f.Counters) != 0 {
+		t.Errorf("Flush kept counters %v", f.Counters)
+	}
+}
+
+func TestServerTCP(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	s := statsite.New("app", statsite.NewClient(server.TCPAddr()))
+	emitAll(s)
+	checkFlushed(t, server, 5)
+}
+
+func TestServerUDP(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	s := statsite.New("app", statsite.NewUDPClient(server.UDPAddr()))
+	emitAll(s)
+	checkFlushed(t, server, 5)
+}
+
+func TestServerSets(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	client := statsite.NewClient(server.TCPAddr())
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range []string{"a", "b", "a"} {
+		client.Emit(statsite.NewSet("users", member))
+	}
+	client.Emit(statsite.Sampled(statsite.NewCounter("hits", 1), 0.5))
+	client.Emit(statsite.NewGauge("load", 1))
+	client.Close()
+	if err := server.Wait(5, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	f := server.Flush()
+	if f.Sets["users"] != 2 {
+		t.Errorf("Set has %d members", f.Sets["users"])
+	}
+	if f.Counters["hits"] != 2 {
+		t.Errorf("Sampled counter summed to %v", f.Counters["hits"])
+	}
+}
+
+func TestServerRejects(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.receive("foo")
+	server.receive("foo:bar|c")
+	server.receive("foo:1|x")
+	if len(server.Errors()) != 3 {
+		t.Fatalf("Expected 3 errors, got %v", server.Errors())
+	}
+	if err := server.Wait(1, time.Millisecond); err == nil {
+		t.Fatal("Wait counted rejected lines")
+	}
+}
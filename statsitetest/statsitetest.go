@@ -0,0 +1,273 @@
+// Package statsitetest records the metrics a program emits so that its tests
+// can assert on them without a statsite server.
+//
+//	rec := statsitetest.NewRecorder()
+//	s := statsite.New("app", rec)
+//	s.CounterAt("hits", 2).Emit()
+//	s.Shutdown()
+//	rec.AssertCounter(t, "app.hits", 2)
+package statsitetest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiip/go-statsite"
+)
+
+// Metric is a line of the statsite protocol parsed back into its parts
+type Metric struct {
+	Key   string
+	Value string
+	Type  statsite.MessageType
+	// Rate is the sample rate the metric was sent at, 1 if it was not
+	// sampled
+	Rate float64
+	// Tags are the DogStatsD tags of the metric. Tags folded into the key
+	// are left in Key.
+	Tags []statsite.Tag
+}
+
+// Float returns the value of the metric as a number
+func (m Metric) Float() (float64, error) {
+	return strconv.ParseFloat(m.Value, 64)
+}
+
+// Parse parses a line of the statsite protocol, with or without its
+// trailing newline
+func Parse(line string) (Metric, error) {
+	line = strings.TrimSuffix(line, "\n")
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return Metric{}, fmt.Errorf("statsitetest: no key in %q", line)
+	}
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 || parts[1] == "" {
+		return Metric{}, fmt.Errorf("statsitetest: no type in %q", line)
+	}
+	m := Metric{
+		Key:   line[:colon],
+		Value: parts[0],
+		Type:  statsite.MessageType(parts[1]),
+		Rate:  1,
+	}
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil {
+				return Metric{}, fmt.Errorf("statsitetest: bad sample rate in %q", line)
+			}
+			m.Rate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "")
+				}
+				m.Tags = append(m.Tags, statsite.Tag{Key: kv[0], Value: kv[1]})
+			}
+		default:
+			return Metric{}, fmt.Errorf("statsitetest: unknown section %q in %q", part, line)
+		}
+	}
+	return m, nil
+}
+
+// Recorder is a statsite.Client that keeps every metric it is sent in
+// memory. Lines that do not parse are kept by Errors.
+type Recorder struct {
+	lock    sync.Mutex
+	metrics []Metric
+	errors  []error
+	// changed is closed and replaced whenever metrics are recorded
+	changed chan struct{}
+}
+
+// NewRecorder returns an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{changed: make(chan struct{})}
+}
+
+// Connect always succeeds
+func (r *Recorder) Connect() error {
+	return nil
+}
+
+// Close does nothing; the recorded metrics are kept
+func (r *Recorder) Close() error {
+	return nil
+}
+
+// Connected is always true
+func (r *Recorder) Connected() bool {
+	return true
+}
+
+// Emit records every line of msg
+func (r *Recorder) Emit(msg statsite.Message) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, line := range strings.SplitAfter(msg.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		m, err := Parse(line)
+		if err != nil {
+			r.errors = append(r.errors, err)
+			continue
+		}
+		r.metrics = append(r.metrics, m)
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return nil
+}
+
+// Metrics returns every metric recorded so far
+func (r *Recorder) Metrics() []Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Metric(nil), r.metrics...)
+}
+
+// Errors returns why any line that did not parse was rejected
+func (r *Recorder) Errors() []error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]error(nil), r.errors...)
+}
+
+// Reset forgets everything recorded so far
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = nil
+	r.errors = nil
+}
+
+// Len returns the number of metrics recorded so far
+func (r *Recorder) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.metrics)
+}
+
+// Wait blocks until at least n metrics have been recorded, returning an
+// error if they have not arrived within timeout
+func (r *Recorder) Wait(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		r.lock.Lock()
+		count, changed := len(r.metrics), r.changed
+		r.lock.Unlock()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("statsitetest: %d of %d metrics arrived within %v", count, n, timeout)
+		}
+	}
+}
+
+// Find returns the metrics recorded for key with type typ
+func (r *Recorder) Find(key string, typ statsite.MessageType) []Metric {
+	var found []Metric
+	for _, m := range r.Metrics() {
+		if m.Key == key && m.Type == typ {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// Counter returns the sum of the counts recorded for key, scaling sampled
+// counts back up the way statsite does
+func (r *Recorder) Counter(key string) float64 {
+	var sum float64
+	for _, m := range r.Find(key, statsite.TYPE_COUNTER) {
+		value, err := m.Float()
+		if err != nil {
+			continue
+		}
+		sum += value / m.Rate
+	}
+	return sum
+}
+
+// Timings returns the timings recorded for key in milliseconds
+func (r *Recorder) Timings(key string) []float64 {
+	var timings []float64
+	for _, m := range r.Find(key, statsite.TYPE_TIMER) {
+		if value, err := m.Float(); err == nil {
+			timings = append(timings, value)
+		}
+	}
+	return timings
+}
+
+// Gauge returns the value of the gauge key after every value and delta
+// recorded for it, and whether any were recorded
+func (r *Recorder) Gauge(key string) (float64, bool) {
+	var gauge float64
+	found := false
+	for _, m := range r.Find(key, statsite.TYPE_GAUGE) {
+		value, err := m.Float()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(m.Value, "+") || strings.HasPrefix(m.Value, "-") {
+			gauge += value
+		} else {
+			gauge = value
+		}
+		found = true
+	}
+	return gauge, found
+}
+
+// Set returns the unique members recorded for the set key
+func (r *Recorder) Set(key string) map[string]bool {
+	members := make(map[string]bool)
+	for _, m := range r.Find(key, statsite.TYPE_SET) {
+		members[m.Value] = true
+	}
+	return members
+}
+
+// AssertCounter fails t unless the counts recorded for key sum to want
+func (r *Recorder) AssertCounter(t testing.TB, key string, want float64) {
+	if got := r.Counter(key); got != want {
+		t.Errorf("statsitetest: counter %s summed to %v, want %v", key, got, want)
+	}
+}
+
+// AssertTimer fails t unless at least one timing was recorded for key
+func (r *Recorder) AssertTimer(t testing.TB, key string) {
+	if len(r.Timings(key)) == 0 {
+		t.Errorf("statsitetest: timer %s was never observed", key)
+	}
+}
+
+// AssertGauge fails t unless the gauge key ended at want
+func (r *Recorder) AssertGauge(t testing.TB, key string, want float64) {
+	got, ok := r.Gauge(key)
+	if !ok {
+		t.Errorf("statsitetest: gauge %s was never set", key)
+	} else if got != want {
+		t.Errorf("statsitetest: gauge %s is %v, want %v", key, got, want)
+	}
+}
+
+// WaitFor fails t now unless at least n metrics are recorded within timeout
+func (r *Recorder) WaitFor(t testing.TB, n int, timeout time.Duration) {
+	if err := r.Wait(n, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
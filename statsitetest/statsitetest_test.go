@@ -0,0 +1,111 @@
+package statsitetest
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiip/go-statsite"
+)
+
+// recordingT is a testing.TB that records failures instead of failing
+type recordingT struct {
+	testing.TB
+	errors []string
+	fatal  bool
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) Fatal(args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprint(args...))
+	t.fatal = true
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse("foo.bar:1.5|ms|@0.5|#a:b,c\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metric{
+		Key:   "foo.bar",
+		Value: "1.5",
+		Type:  statsite.TYPE_TIMER,
+		Rate:  0.5,
+		Tags:  []statsite.Tag{{Key: "a", Value: "b"}, {Key: "c"}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("Parse returned %+v, want %+v", m, want)
+	}
+	for _, line := range []string{"foo", ":1|c", "foo:1", "foo:1|c|@x", "foo:1|c|x"} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("Parse(%q) did not fail", line)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	s := statsite.New("app", rec)
+	s.CounterAt("hits", 2).Emit()
+	s.CounterAt("hits", 3).Emit()
+	s.SampledCounter("sampled", 0.5).Emit()
+	s.Timer("time").Emit()
+	s.GaugeAt("load", 5).Emit()
+	s.GaugeDelta("load", -2).Emit()
+	s.KeyValue("key", "value").Emit()
+	s.Shutdown()
+
+	rec.AssertCounter(t, "app.hits", 5)
+	rec.AssertTimer(t, "app.time")
+	rec.AssertGauge(t, "app.load", 3)
+	if len(rec.Errors()) > 0 {
+		t.Fatalf("Recorder rejected lines: %v", rec.Errors())
+	}
+	// The sampled counter may or may not have been emitted
+	if sum := rec.Counter("app.sampled"); sum != 0 && sum != 2 {
+		t.Fatalf("Sampled counter summed to %v", sum)
+	}
+}
+
+func TestAssertionsFail(t *testing.T) {
+	rec := NewRecorder()
+	rec.Emit(statsite.NewCounter("hits", 1))
+	rec.Emit(statsite.NewGauge("load", 1))
+
+	ft := &recordingT{TB: t}
+	rec.AssertCounter(ft, "hits", 2)
+	rec.AssertTimer(ft, "time")
+	rec.AssertGauge(ft, "load", 2)
+	rec.AssertGauge(ft, "missing", 0)
+	if len(ft.errors) != 4 {
+		t.Fatalf("Expected 4 failures, got %v", ft.errors)
+	}
+}
+
+func TestWait(t *testing.T) {
+	rec := NewRecorder()
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(time.Millisecond)
+			rec.Emit(statsite.NewSet("users", fmt.Sprint(i%2)))
+		}
+	}()
+	rec.WaitFor(t, 3, time.Second)
+	if len(rec.Set("users")) != 2 {
+		t.Fatalf("Expected 2 members, got %v", rec.Set("users"))
+	}
+
+	ft := &recordingT{TB: t}
+	rec.WaitFor(ft, 4, time.Millisecond)
+	if !ft.fatal {
+		t.Fatal("WaitFor did not fail")
+	}
+	rec.Reset()
+	if rec.Len() != 0 {
+		t.Fatal("Reset kept metrics")
+	}
+}
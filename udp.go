@@ -0,0 +1,183 @@
+package statsite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultPacketSize keeps a datagram within a 1500 byte Ethernet MTU once
+	// the IP and UDP headers are added
+	DefaultPacketSize = 1432
+	// MaxPacketSize is the largest payload a single UDP datagram can carry
+	MaxPacketSize = 65507
+)
+
+// udpClient is an implementation of the Client interface that packs as many
+// messages as fit into each datagram it sends
+type udpClient struct {
+	Conn       net.Conn
+	addr       string
+	transport  string
+	network    Network
+	redial     redial
+	packetSize int
+	packet     []byte
+	encoder    Encoder
+	timeout    time.Duration
+	deadlines  deadlines
+	connState
+	// buf is reused to encode each message
+	buf []byte
+}
+
+// NewUDPClientWithOptions takes an address string in the form "host:port" and
+// ClientOptions and returns a Client that sends datagrams of at most
+// opts.PacketSize bytes. An address of the form unixgram:///path sends to a
+// unix domain datagram socket instead, and one of the form unix:///path
+// returns the stream Client of NewClientWithOptions.
+func NewUDPClientWithOptions(addr string, opts ClientOptions) Client {
+	transport := "udp"
+	if network, path, ok := splitUnixAddr(addr); ok {
+		if network == "unix" {
+			return NewClientWithOptions(addr, opts)
+		}
+		transport, addr = network, path
+	}
+	packetSize := opts.PacketSize
+	if packetSize <= 0 {
+		packetSize = DefaultPacketSize
+	}
+	if packetSize > MaxPacketSize {
+		packetSize = MaxPacketSize
+	}
+	return &udpClient{
+		Conn:       nil,
+		addr:       addr,
+		transport:  transport,
+		network:    opts.network(),
+		redial:     redial{backoff: opts.Backoff},
+		packetSize: packetSize,
+		packet:     make([]byte, 0, packetSize),
+		encoder:    opts.encoder(),
+		timeout:    opts.dialTimeout(),
+		deadlines:  opts.deadlines(),
+	}
+}
+
+// NewUDPNetworkClient takes an address string in the form "host:port", a
+// Network and the largest datagram to send and returns a Client. A packetSize
+// of zero or less uses DefaultPacketSize.
+func NewUDPNetworkClient(addr string, network Network, packetSize int) Client {
+	return NewUDPClientWithOptions(addr, ClientOptions{
+		Network:    network,
+		PacketSize: packetSize,
+	})
+}
+
+// NewUDPClient takes an address string in the form "host:port" and returns a
+// Client that sends DefaultPacketSize datagrams on a realNetwork
+func NewUDPClient(addr string) Client {
+	network := &realNetwork{}
+	return NewUDPNetworkClient(addr, network, DefaultPacketSize)
+}
+
+// Connect instructs a Client to make a connection to the server at the address
+// specified in the client
+func (t *udpClient) Connect() error {
+	// Reconnecting replaces any connection already held, sending anything
+	// left in the packet first
+	t.Close()
+
+	err := t.redial.allow()
+	if err != nil {
+		return fmt.Errorf("Error connecting to statsite: %v", err)
+	}
+
+	err = resolve(t.network, t.transport, t.addr)
+	if err != nil {
+		t.redial.failed()
+		return fmt.Errorf("Error resolving statsite: %v", err)
+	}
+
+	conn, err := t.network.DialTimeout(t.transport, t.addr, t.timeout)
+	if err != nil {
+		t.redial.failed()
+		return fmt.Errorf("Error connecting to statsite: %v", err)
+	}
+	t.redial.succeeded()
+	t.deadlines.connected()
+	t.Conn = conn
+	t.set(true)
+	return nil
+}
+
+// Close sends any partially filled packet and closes the connection, if
+// there is one
+func (t *udpClient) Close() error {
+	if t.Conn == nil {
+		t.packet = t.packet[:0]
+		return nil
+	}
+	err := t.Flush()
+	if closeErr := t.Conn.Close(); err == nil {
+		err = closeErr
+	}
+	t.Conn = nil
+	t.set(false)
+	return err
+}
+
+// Emit adds a message to the current packet, sending the packet first if the
+// message would not fit in it. Messages are not sent until a packet fills up
+// or Flush is called.
+func (t *udpClient) Emit(msg Message) error {
+	if t.Conn == nil || t.deadlines.expired() {
+		err := t.Connect()
+		if err != nil {
+			return err
+		}
+	}
+	t.buf = t.encoder.Encode(t.buf[:0], msg)
+	for rest := t.buf; len(rest) > 0; {
+		n := bytes.IndexByte(rest, '\n') + 1
+		if n == 0 {
+			n = len(rest)
+		}
+		line := rest[:n]
+		rest = rest[n:]
+		if len(line) > MaxPacketSize {
+			return fmt.Errorf("Message of %d bytes exceeds the maximum UDP packet size", len(line))
+		}
+		if len(t.packet) > 0 && len(t.packet)+len(line) > t.packetSize {
+			if err := t.Flush(); err != nil {
+				return err
+			}
+		}
+		t.packet = append(t.packet, line...)
+	}
+	if len(t.packet) >= t.packetSize {
+		return t.Flush()
+	}
+	return nil
+}
+
+// Encoder returns the Encoder the client sends messages with
+func (t *udpClient) Encoder() Encoder {
+	return t.encoder
+}
+
+// Flush sends the current packet if it holds any messages
+func (t *udpClient) Flush() error {
+	if len(t.packet) == 0 {
+		return nil
+	}
+	if t.Conn == nil {
+		return fmt.Errorf("Error flushing to statsite: not connected")
+	}
+	err := t.deadlines.writeTo(t.Conn, t.packet)
+	t.packet = t.packet[:0]
+	return err
+}
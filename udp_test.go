@@ -0,0 +1,104 @@
+package statsite
+
+import (
+	"fmt"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type UDPSuite struct {
+	mockNetwork  Network
+	mockStatsite *mockStatsite
+}
+
+var _ = Suite(&UDPSuite{})
+
+func (s *UDPSuite) SetUpTest(c *C) {
+	s.mockStatsite = &mockStatsite{}
+	serverMap := make(map[string]mockServer)
+	serverMap["statsite"] = mockServer(s.mockStatsite)
+	s.mockNetwork = NewMockNetwork(serverMap)
+}
+
+func (s *UDPSuite) TestConnect(c *C) {
+	m := NewUDPNetworkClient("statsite", s.mockNetwork, 0)
+	err := m.Connect()
+	c.Assert(err, IsNil)
+	c.Assert(m.(*udpClient).Conn, NotNil)
+	c.Assert(m.(*udpClient).packetSize, Equals, DefaultPacketSize)
+}
+
+func (s *UDPSuite) TestConnectInvalidAddress(c *C) {
+	m := NewUDPNetworkClient("invalid", s.mockNetwork, 0)
+	err := m.Connect()
+	c.Assert(err, ErrorMatches, "Error resolving statsite:.*")
+}
+
+func (s *UDPSuite) TestConnectBadConnection(c *C) {
+	m := NewUDPNetworkClient("badconnection", s.mockNetwork, 0)
+	err := m.Connect()
+	c.Assert(err, ErrorMatches, "Error connecting to statsite:.*")
+}
+
+func (s *UDPSuite) TestEmitBuffersUntilFlush(c *C) {
+	m := NewUDPNetworkClient("statsite", s.mockNetwork, 0)
+	msg := NewKeyValue("key", "value")
+	for i := 0; i < 3; i++ {
+		c.Assert(m.Emit(msg), IsNil)
+	}
+	c.Assert(s.mockStatsite.Count(), Equals, 0)
+	c.Assert(m.(Flusher).Flush(), IsNil)
+	// All three messages arrive in a single packet
+	c.Assert(s.mockStatsite.Writes(), Equals, 1)
+	c.Assert(s.mockStatsite.Count(), Equals, 3)
+	c.Assert(s.mockStatsite.Last(), Equals, msg.String())
+}
+
+func (s *UDPSuite) TestEmitSplitsPackets(c *C) {
+	msg := NewKeyValue("key", "value")
+	size := len(msg.String())
+	// Room for two messages per packet
+	m := NewUDPNetworkClient("statsite", s.mockNetwork, 2*size+1)
+	for i := 0; i < 5; i++ {
+		c.Assert(m.Emit(msg), IsNil)
+	}
+	c.Assert(s.mockStatsite.Writes(), Equals, 2)
+	c.Assert(m.(Flusher).Flush(), IsNil)
+	c.Assert(s.mockStatsite.Writes(), Equals, 3)
+	c.Assert(s.mockStatsite.Count(), Equals, 5)
+}
+
+func (s *UDPSuite) TestEmitOversizedMessage(c *C) {
+	m := NewUDPNetworkClient("statsite", s.mockNetwork, 16)
+	c.Assert(m.Emit(NewKeyValue("a", "b")), IsNil)
+	big := NewKeyValue("key", strings.Repeat("x", 32))
+	// An oversized message still goes out, alone in its own packet
+	c.Assert(m.Emit(big), IsNil)
+	c.Assert(s.mockStatsite.Writes(), Equals, 2)
+	c.Assert(s.mockStatsite.Last(), Equals, big.String())
+
+	huge := NewKeyValue("key", strings.Repeat("x", MaxPacketSize))
+	c.Assert(m.Emit(huge), ErrorMatches, "Message of .* bytes exceeds the maximum UDP packet size")
+}
+
+func (s *UDPSuite) TestCloseFlushes(c *C) {
+	m := NewUDPNetworkClient("statsite", s.mockNetwork, 0)
+	c.Assert(m.Emit(NewKeyValue("key", "value")), IsNil)
+	conn := m.(*udpClient).Conn.(*mockConnection)
+	c.Assert(m.Connected(), Equals, true)
+	c.Assert(m.Close(), IsNil)
+	c.Assert(s.mockStatsite.Count(), Equals, 1)
+	c.Assert(m.(*udpClient).Conn, IsNil)
+	c.Assert(conn.closed, Equals, true)
+	c.Assert(m.Connected(), Equals, false)
+}
+
+func (s *UDPSuite) TestFlushLoop(c *C) {
+	InitializeWithClient("foo.bar", NewUDPNetworkClient("statsite", s.mockNetwork, 0))
+	for i := 0; i < 10; i++ {
+		KeyValue(fmt.Sprintf("key%d", i), "value").Emit()
+	}
+	Shutdown()
+	c.Assert(s.mockStatsite.Count(), Equals, 10)
+}
@@ -0,0 +1,42 @@
+package statsite
+
+import "strings"
+
+const (
+	// UnixScheme prefixes the path of a unix domain stream socket, as in
+	// unix:///var/run/statsite.sock
+	UnixScheme = "unix://"
+	// UnixgramScheme prefixes the path of a unix domain datagram socket, as
+	// in unixgram:///var/run/statsite.sock
+	UnixgramScheme = "unixgram://"
+)
+
+// splitUnixAddr returns the network and path of a unix:// or unixgram://
+// address, or false for any other address
+func splitUnixAddr(addr string) (network, path string, ok bool) {
+	switch {
+	case strings.HasPrefix(addr, UnixScheme):
+		return "unix", addr[len(UnixScheme):], true
+	case strings.HasPrefix(addr, UnixgramScheme):
+		return "unixgram", addr[len(UnixgramScheme):], true
+	}
+	return "", "", false
+}
+
+// resolve resolves address on network using the Network's resolver for it,
+// doing nothing if the Network has none
+func resolve(n Network, network, address string) error {
+	switch network {
+	case "unix", "unixgram":
+		if r, ok := n.(UnixResolver); ok {
+			return r.ResolveUnixAddr(network, address)
+		}
+		return nil
+	case "udp":
+		if r, ok := n.(UDPResolver); ok {
+			return r.ResolveUDPAddr(network, address)
+		}
+		return nil
+	}
+	return n.ResolveTCPAddr(network, address)
+}
@@ -0,0 +1,185 @@
+package statsite
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type UnixSuite struct {
+	mockNetwork  Network
+	mockStatsite *mockStatsite
+}
+
+var _ = Suite(&UnixSuite{})
+
+func (s *UnixSuite) SetUpTest(c *C) {
+	s.mockStatsite = &mockStatsite{}
+	serverMap := make(map[string]mockServer)
+	serverMap["/statsite.sock"] = mockServer(s.mockStatsite)
+	s.mockNetwork = NewMockNetwork(serverMap)
+}
+
+func (s *UnixSuite) TestSplitUnixAddr(c *C) {
+	network, path, ok := splitUnixAddr("unix:///var/run/statsite.sock")
+	c.Assert(ok, Equals, true)
+	c.Assert(network, Equals, "unix")
+	c.Assert(path, Equals, "/var/run/statsite.sock")
+	network, path, ok = splitUnixAddr("unixgram:///var/run/statsite.sock")
+	c.Assert(ok, Equals, true)
+	c.Assert(network, Equals, "unixgram")
+	c.Assert(path, Equals, "/var/run/statsite.sock")
+	_, _, ok = splitUnixAddr("localhost:8125")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *UnixSuite) TestResolveOptional(c *C) {
+	c.Assert(resolve(s.mockNetwork, "unix", "invalid"), NotNil)
+	c.Assert(resolve(s.mockNetwork, "udp", "invalid"), NotNil)
+	// A Network with only the required methods skips resolving
+	basic := struct{ Network }{s.mockNetwork}
+	c.Assert(resolve(basic, "unix", "invalid"), IsNil)
+	c.Assert(resolve(basic, "udp", "invalid"), IsNil)
+	c.Assert(resolve(basic, "tcp", "invalid"), NotNil)
+}
+
+func (s *UnixSuite) TestSchemeChoosesClient(c *C) {
+	c.Assert(NewClient("unix:///statsite.sock"), FitsTypeOf, &client{})
+	c.Assert(NewClient("unixgram:///statsite.sock"), FitsTypeOf, &udpClient{})
+	c.Assert(NewUDPClient("unix:///statsite.sock"), FitsTypeOf, &client{})
+	c.Assert(NewUDPClient("unixgram:///statsite.sock"), FitsTypeOf, &udpClient{})
+}
+
+func (s *UnixSuite) TestMockNetwork(c *C) {
+	m := NewNetworkClient("unix:///statsite.sock", s.mockNetwork)
+	c.Assert(m.Connect(), IsNil)
+	c.Assert(m.Emit(NewCounter("foo", 1)), IsNil)
+	c.Assert(s.mockStatsite.Read(), DeepEquals, []string{"foo:1|c\n"})
+
+	m = NewNetworkClient("unix://invalid", s.mockNetwork)
+	c.Assert(m.Connect(), ErrorMatches, "Error resolving statsite:.*")
+}
+
+// listenUnix serves a unix domain stream socket at path, sending every line
+// received on lines. The returned func stops the server as a restarted
+// statsite would, closing the listener and every connection.
+func listenUnix(c *C, path string, lines chan<- string) func() {
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	var lock sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return func() {
+		l.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// listenUnixgram reads a unix domain datagram socket at path, sending every
+// line received on lines
+func listenUnixgram(c *C, path string, lines chan<- string) net.PacketConn {
+	conn, err := net.ListenPacket("unixgram", path)
+	c.Assert(err, IsNil)
+	go func() {
+		packet := make([]byte, MaxPacketSize)
+		for {
+			n, _, err := conn.ReadFrom(packet)
+			if err != nil {
+				return
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(packet[:n])), "\n") {
+				lines <- line
+			}
+		}
+	}()
+	return conn
+}
+
+// emitUntil emits a counter until want arrives on lines
+func emitUntil(c *C, st *Statsite, lines <-chan string, want string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		st.CounterAt("hits", 1).Emit()
+		select {
+		case line := <-lines:
+			if line == want {
+				return
+			}
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			c.Fatalf("%s never arrived", want)
+		}
+	}
+}
+
+func (s *UnixSuite) TestUnixReconnect(c *C) {
+	path := filepath.Join(c.MkDir(), "statsite.sock")
+	lines := make(chan string, 100)
+	stop := listenUnix(c, path, lines)
+	st := New("app", NewClient("unix://"+path),
+		WithFlushInterval(time.Millisecond),
+		WithBackoff(ConstantBackoff(time.Millisecond)),
+	)
+	defer st.Shutdown()
+	emitUntil(c, st, lines, "app.hits:1|c")
+
+	// Recreate the socket file as a restarted statsite would
+	stop()
+	os.Remove(path)
+	stop = listenUnix(c, path, lines)
+	defer stop()
+	for len(lines) > 0 {
+		<-lines
+	}
+	emitUntil(c, st, lines, "app.hits:1|c")
+	c.Assert(st.Stats().Reconnects > 0, Equals, true)
+}
+
+func (s *UnixSuite) TestUnixgramReconnect(c *C) {
+	path := filepath.Join(c.MkDir(), "statsite.sock")
+	lines := make(chan string, 100)
+	conn := listenUnixgram(c, path, lines)
+	st := New("app", NewClient("unixgram://"+path),
+		WithFlushInterval(time.Millisecond),
+		WithBackoff(ConstantBackoff(time.Millisecond)),
+	)
+	defer st.Shutdown()
+	emitUntil(c, st, lines, "app.hits:1|c")
+
+	conn.Close()
+	os.Remove(path)
+	conn = listenUnixgram(c, path, lines)
+	defer conn.Close()
+	for len(lines) > 0 {
+		<-lines
+	}
+	emitUntil(c, st, lines, "app.hits:1|c")
+	c.Assert(st.Stats().Reconnects > 0, Equals, true)
+}
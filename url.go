@@ -0,0 +1,137 @@
+package statsite
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// clientURL is a statsite address URL split into the ClientOptions for its
+// Client and the Options for a Statsite sending to it
+type clientURL struct {
+	addr    string
+	udp     bool
+	client  ClientOptions
+	prefix  string
+	options []Option
+}
+
+// parseURL parses a URL in the format described by NewFromURL
+func parseURL(rawurl string) (*clientURL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid statsite URL: %v", err)
+	}
+	c := &clientURL{}
+	switch u.Scheme {
+	case "tcp", "udp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("Invalid statsite URL %q: no host:port", rawurl)
+		}
+		c.addr = u.Host
+		c.udp = u.Scheme == "udp"
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return nil, fmt.Errorf("Invalid statsite URL %q: no socket path", rawurl)
+		}
+		c.addr = u.Scheme + "://" + u.Path
+	default:
+		return nil, fmt.Errorf("Invalid statsite URL %q: scheme must be tcp, udp, unix or unixgram", rawurl)
+	}
+
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("Invalid statsite URL %q: bad timeout %q", rawurl, value)
+			}
+			c.client.DialTimeout = timeout
+		case "write":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid statsite URL %q: bad write %q", rawurl, value)
+			}
+			c.client.WriteTimeout = timeout
+		case "idle":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("Invalid statsite URL %q: bad idle %q", rawurl, value)
+			}
+			c.client.IdleTimeout = timeout
+		case "batch":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("Invalid statsite URL %q: bad batch %q", rawurl, value)
+			}
+			c.client.PacketSize = size
+			c.options = append(c.options, WithBatchSize(size))
+		case "flush":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("Invalid statsite URL %q: bad flush %q", rawurl, value)
+			}
+			c.options = append(c.options, WithFlushInterval(interval))
+		case "prefix":
+			c.prefix = value
+		default:
+			return nil, fmt.Errorf("Invalid statsite URL %q: unknown parameter %q", rawurl, name)
+		}
+	}
+	return c, nil
+}
+
+func (c *clientURL) newClient() Client {
+	if c.udp {
+		return NewUDPClientWithOptions(c.addr, c.client)
+	}
+	return NewClientWithOptions(c.addr, c.client)
+}
+
+// NewClientFromURL returns a Client for a URL such as
+// udp://localhost:8125?timeout=500ms&batch=1400, choosing the transport from
+// the scheme. See NewFromURL for the URL format; the prefix and flush
+// parameters are accepted but only apply to a Statsite.
+func NewClientFromURL(rawurl string) (Client, error) {
+	c, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return c.newClient(), nil
+}
+
+// NewFromURL creates a Statsite sending to the Client for a URL of the form
+// scheme://address?param=value and starts its flusher. The scheme is tcp,
+// udp, unix or unixgram; unix sockets take a path, as in
+// unix:///var/run/statsite.sock. The parameters are
+//
+//	timeout  how long to wait for a connection, as in 500ms
+//	write    how long a write may block, negative for no limit
+//	idle     how long a connection may go unused before reconnecting
+//	batch    the largest batch or datagram to send in bytes
+//	flush    the longest a partial batch is held, as in 100ms
+//	prefix   the prefix of every metric key
+//
+// opts are applied after the URL, so they take precedence over it.
+func NewFromURL(rawurl string, opts ...Option) (*Statsite, error) {
+	c, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return New(c.prefix, c.newClient(), append(c.options, opts...)...), nil
+}
+
+// InitializeFromURL starts the package level Statsite with the Client, prefix
+// and options of a URL, as described by NewFromURL
+func InitializeFromURL(rawurl string, opts ...Option) error {
+	c, err := parseURL(rawurl)
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting stats collector [%s] on [%s]\n", c.prefix, c.addr)
+	InitializeWithClient(c.prefix, c.newClient(), append(c.options, opts...)...)
+	return nil
+}
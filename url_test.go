@@ -0,0 +1,85 @@
+package statsite
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type URLSuite struct{}
+
+var _ = Suite(&URLSuite{})
+
+func (s *URLSuite) TestParseURL(c *C) {
+	u, err := parseURL("udp://localhost:8125?batch=1400&timeout=500ms&prefix=app&flush=1s")
+	c.Assert(err, IsNil)
+	c.Assert(u.addr, Equals, "localhost:8125")
+	c.Assert(u.udp, Equals, true)
+	c.Assert(u.prefix, Equals, "app")
+	c.Assert(u.client.DialTimeout, Equals, 500*time.Millisecond)
+	c.Assert(u.client.PacketSize, Equals, 1400)
+	o := newOptions(u.options)
+	c.Assert(o.batchSize, Equals, 1400)
+	c.Assert(o.flushInterval, Equals, time.Second)
+
+	u, err = parseURL("unix:///var/run/statsite.sock")
+	c.Assert(err, IsNil)
+	c.Assert(u.addr, Equals, "unix:///var/run/statsite.sock")
+	c.Assert(u.udp, Equals, false)
+}
+
+func (s *URLSuite) TestParseURLErrors(c *C) {
+	for _, rawurl := range []string{
+		"localhost:8125",
+		"http://localhost:8125",
+		"tcp://",
+		"unix://",
+		"tcp://localhost:8125?timeout=soon",
+		"tcp://localhost:8125?batch=-1",
+		"tcp://localhost:8125?flush=0s",
+		"tcp://localhost:8125?bacth=1400",
+		"tcp://localhost:8125?write=never",
+		"tcp://localhost:8125?idle=-1s",
+	} {
+		_, err := parseURL(rawurl)
+		c.Assert(err, ErrorMatches, "Invalid statsite URL.*", Commentf(rawurl))
+	}
+}
+
+func (s *URLSuite) TestNewClientFromURL(c *C) {
+	m, err := NewClientFromURL("udp://localhost:8125?batch=512&timeout=2s")
+	c.Assert(err, IsNil)
+	c.Assert(m.(*udpClient).packetSize, Equals, 512)
+	c.Assert(m.(*udpClient).timeout, Equals, 2*time.Second)
+
+	m, err = NewClientFromURL("tcp://localhost:8125")
+	c.Assert(err, IsNil)
+	c.Assert(m.(*client).timeout, Equals, DefaultDialTimeout)
+	c.Assert(m.(*client).deadlines.write, Equals, DefaultWriteTimeout)
+
+	m, err = NewClientFromURL("tcp://localhost:8125?write=100ms&idle=1m")
+	c.Assert(err, IsNil)
+	c.Assert(m.(*client).deadlines.write, Equals, 100*time.Millisecond)
+	c.Assert(m.(*client).deadlines.idle, Equals, time.Minute)
+
+	m, err = NewClientFromURL("unixgram:///var/run/statsite.sock")
+	c.Assert(err, IsNil)
+	c.Assert(m.(*udpClient).transport, Equals, "unixgram")
+	c.Assert(m.(*udpClient).addr, Equals, "/var/run/statsite.sock")
+
+	_, err = NewClientFromURL("ftp://localhost")
+	c.Assert(err, NotNil)
+}
+
+func (s *URLSuite) TestNewFromURL(c *C) {
+	st, err := NewFromURL("tcp://127.0.0.1:1?prefix=app&flush=1h", WithFlushInterval(time.Millisecond))
+	c.Assert(err, IsNil)
+	defer st.Shutdown()
+	c.Assert(st.State(), Equals, StateRunning)
+	st.l.RLock()
+	c.Assert(st.prefix, Equals, "app")
+	st.l.RUnlock()
+
+	_, err = NewFromURL("tcp://127.0.0.1:1?prefix=app&nope=1")
+	c.Assert(err, ErrorMatches, `.*unknown parameter "nope"`)
+}